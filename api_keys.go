@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DEFAULT_API_KEY_HEADER = "X-Api-Key"
+	UNKNOWN_KEY_ANONYMOUS  = "anonymous" //Limit requests with unknown keys by client IP
+	UNKNOWN_KEY_REJECT     = "reject"    //Reject requests with unknown keys with 401
+
+	keySourceFile  = "file"
+	keySourceAdmin = "admin"
+)
+
+var (
+	keyRegistry      = NewKeyRegistry()
+	errUnknownAPIKey = errors.New("unknown api key")
+)
+
+//APIKeysConfig limits requests carrying an API key by key.
+//
+//	api_keys:
+//	  header: X-Api-Key
+//	  file: keys.yml
+//	  unknown_key: reject
+type APIKeysConfig struct {
+	Header     string `json:"header,omitempty" yaml:"header,omitempty"`
+	QueryParam string `json:"query_param,omitempty" yaml:"query_param,omitempty"`
+	File       string `json:"file,omitempty" yaml:"file,omitempty"`
+	UnknownKey string `json:"unknown_key,omitempty" yaml:"unknown_key,omitempty"`
+
+	keys []*APIKey
+}
+
+//APIKey is a registered key with its owner and limits
+type APIKey struct {
+	Key       string     `json:"key" yaml:"key"`
+	Owner     string     `json:"owner" yaml:"owner"`
+	Tier      string     `json:"tier,omitempty" yaml:"tier,omitempty"`
+	Limit     int        `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Enabled   bool       `json:"enabled" yaml:"enabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+
+	source string
+}
+
+//KeyUsage is the usage of a key reported in /stats/api-keys
+type KeyUsage struct {
+	ID        string     `json:"id"`
+	Owner     string     `json:"owner"`
+	Tier      string     `json:"tier,omitempty"`
+	Requests  int64      `json:"requests"`
+	Rejected  int64      `json:"rejected"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+//Validates the settings and loads the keys file
+func (c *APIKeysConfig) validate() error {
+	if c.Header == "" && c.QueryParam == "" {
+		c.Header = DEFAULT_API_KEY_HEADER
+	}
+	if c.UnknownKey == "" {
+		c.UnknownKey = UNKNOWN_KEY_ANONYMOUS
+	}
+	if c.UnknownKey != UNKNOWN_KEY_ANONYMOUS && c.UnknownKey != UNKNOWN_KEY_REJECT {
+		return fmt.Errorf("unknown_key must be %q or %q", UNKNOWN_KEY_ANONYMOUS, UNKNOWN_KEY_REJECT)
+	}
+	if c.File == "" {
+		return nil
+	}
+
+	keys, err := loadKeysFile(c.File)
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	return nil
+}
+
+func loadKeysFile(path string) ([]*APIKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*APIKey
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &keys)
+	} else {
+		err = yaml.UnmarshalStrict(data, &keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keys file: %s", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, k := range keys {
+		if err := k.validate(); err != nil {
+			return nil, fmt.Errorf("key %d: %s", i, err)
+		}
+		if seen[k.Key] {
+			return nil, fmt.Errorf("key %d: duplicate key", i)
+		}
+		seen[k.Key] = true
+		k.source = keySourceFile
+	}
+	return keys, nil
+}
+
+func (k *APIKey) validate() error {
+	if k.Key == "" {
+		return errors.New("key is required")
+	}
+	if k.Owner == "" {
+		return errors.New("owner is required")
+	}
+	if k.Limit != 0 {
+		return validateLimit(k.Limit)
+	}
+	return nil
+}
+
+//The id of a key, stats and admin endpoints never show the key itself
+func (k *APIKey) ID() string {
+	return keyID(k.Key)
+}
+
+//Derives the id from 128 bits of the SHA-256 of the key, so ids of different keys do not collide
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (k *APIKey) active(now time.Time) bool {
+	return k.Enabled && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+func (c *APIKeysConfig) keyFrom(req *http.Request) string {
+	if c.Header != "" {
+		if key := req.Header.Get(c.Header); key != "" {
+			return key
+		}
+	}
+	if c.QueryParam != "" {
+		return req.URL.Query().Get(c.QueryParam)
+	}
+	return ""
+}
+
+//Identifies the client by a key, unknown, disabled and expired keys are
+//limited as anonymous clients or rejected
+func (c *APIKeysConfig) identify(key string, remoteIP string) (Identity, error) {
+	k := keyRegistry.Get(keyID(key))
+	if k == nil || k.Key != key || !k.active(time.Now()) {
+		log.Printf("unknown, disabled or expired api key from [%s]\n", remoteIP)
+		if c.UnknownKey == UNKNOWN_KEY_REJECT {
+			return Identity{Key: remoteIP}, errUnknownAPIKey
+		}
+		return Identity{Key: remoteIP}, nil
+	}
+	return Identity{Key: "key:" + k.ID(), Tier: k.Tier, Limit: k.Limit, KeyID: k.ID()}, nil
+}
+
+//KeyRegistry holds the API keys loaded from the keys file and managed through
+//the admin endpoints, with their usage
+type KeyRegistry struct {
+	keys  map[string]*APIKey
+	usage map[string]*KeyUsage
+	sync.RWMutex
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{
+		keys:  make(map[string]*APIKey),
+		usage: make(map[string]*KeyUsage),
+	}
+}
+
+//Replaces the keys loaded from the keys file. Keys managed through the admin
+//endpoints are kept and take precedence over file keys with the same key.
+func (r *KeyRegistry) LoadFileKeys(keys []*APIKey) {
+	r.Lock()
+	defer r.Unlock()
+	for id, k := range r.keys {
+		if k.source == keySourceFile {
+			delete(r.keys, id)
+		}
+	}
+	for _, k := range keys {
+		existing, ok := r.keys[k.ID()]
+		if !ok {
+			r.keys[k.ID()] = k
+		} else if existing.Key != k.Key {
+			log.Printf("Ignoring api key for [%s], its id [%s] collides with another key\n", k.Owner, k.ID())
+		}
+	}
+}
+
+func (r *KeyRegistry) Get(id string) *APIKey {
+	r.RLock()
+	defer r.RUnlock()
+	return r.keys[id]
+}
+
+//Adds or replaces the key, rejecting it when its id is taken by a different key
+func (r *KeyRegistry) Put(k *APIKey) error {
+	r.Lock()
+	defer r.Unlock()
+	if existing, ok := r.keys[k.ID()]; ok && existing.Key != k.Key {
+		return fmt.Errorf("key id %s collides with another key", k.ID())
+	}
+	r.keys[k.ID()] = k
+	return nil
+}
+
+func (r *KeyRegistry) Delete(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.keys[id]
+	delete(r.keys, id)
+	delete(r.usage, id)
+	return ok
+}
+
+//Counts a request made with the key
+func (r *KeyRegistry) Record(id string, rejected bool) {
+	r.Lock()
+	defer r.Unlock()
+	u, ok := r.usage[id]
+	if !ok {
+		u = &KeyUsage{ID: id}
+		r.usage[id] = u
+	}
+	now := time.Now()
+	u.Requests++
+	if rejected {
+		u.Rejected++
+	}
+	u.LastUsed = &now
+}
+
+//Returns every key with its usage, sorted by owner
+func (r *KeyRegistry) Usage() []KeyUsage {
+	r.RLock()
+	defer r.RUnlock()
+	usage := []KeyUsage{}
+	for id, k := range r.keys {
+		u := KeyUsage{ID: id}
+		if recorded, ok := r.usage[id]; ok {
+			u = *recorded
+		}
+		u.Owner = k.Owner
+		u.Tier = k.Tier
+		u.Enabled = k.Enabled
+		u.ExpiresAt = k.ExpiresAt
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Owner != usage[j].Owner {
+			return usage[i].Owner < usage[j].Owner
+		}
+		return usage[i].ID < usage[j].ID
+	})
+	return usage
+}
+
+func keyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := json.Marshal(keyRegistry.Usage())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", usage)
+}
+
+//Admin API for the key registry:
+//
+//	GET    /api-keys       lists the keys with their usage
+//	POST   /api-keys       creates a key, a random key is generated when none is given
+//	PUT    /api-keys/<id>  replaces the owner, tier, limit, enabled flag and expiry of a key
+//	DELETE /api-keys/<id>  removes a key
+//
+//Keys created through the API are kept in memory only.
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api-keys"), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		keyUsageHandler(w, r)
+	case r.Method == "POST" && id == "":
+		k, err := decodeKey(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if k.Key == "" {
+			k.Key = generateKey()
+		}
+		if err := k.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if keyRegistry.Get(k.ID()) != nil {
+			http.Error(w, "key already exists", 409)
+			return
+		}
+		if err := keyRegistry.Put(k); err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		log.Printf("Created api key [%s] for [%s]\n", k.ID(), k.Owner)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(struct {
+			ID string `json:"id"`
+			*APIKey
+		}{k.ID(), k})
+	case r.Method == "PUT" && id != "":
+		existing := keyRegistry.Get(id)
+		if existing == nil {
+			http.NotFound(w, r)
+			return
+		}
+		k, err := decodeKey(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		k.Key = existing.Key
+		if err := k.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := keyRegistry.Put(k); err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		log.Printf("Updated api key [%s]\n", id)
+		w.WriteHeader(204)
+	case r.Method == "DELETE" && id != "":
+		if !keyRegistry.Delete(id) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Deleted api key [%s]\n", id)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func decodeKey(r *http.Request) (*APIKey, error) {
+	k := &APIKey{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(k); err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	k.source = keySourceAdmin
+	return k, nil
+}
+
+func generateKey() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//Requires the ADMIN_TOKEN as bearer token, the admin endpoints are disabled when it is not set
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "Admin endpoints are disabled, set ADMIN_TOKEN to enable them", 403)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		handler(w, r)
+	}
+}
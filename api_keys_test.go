@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("API keys", func() {
+	var (
+		cfg     *APIKeysConfig
+		tempDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "api-keys")
+		Expect(err).ToNot(HaveOccurred())
+
+		keysFile := filepath.Join(tempDir, "keys.yml")
+		Expect(ioutil.WriteFile(keysFile, []byte(`
+- key: key-alice
+  owner: alice
+  tier: pro
+  enabled: true
+- key: key-bob
+  owner: bob
+  limit: 2
+  enabled: false
+- key: key-carol
+  owner: carol
+  enabled: true
+  expires_at: 2001-01-01T00:00:00Z
+`), 0644)).To(Succeed())
+
+		keyRegistry = NewKeyRegistry()
+		cfg = &APIKeysConfig{File: keysFile}
+		Expect(cfg.validate()).To(Succeed())
+		keyRegistry.LoadFileKeys(cfg.keys)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("identify", func() {
+		It("limits known keys by key", func() {
+			id, err := cfg.identify("key-alice", "10.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id.Key).To(Equal("key:" + keyID("key-alice")))
+			Expect(id.Tier).To(Equal("pro"))
+			Expect(id.KeyID).To(Equal(keyID("key-alice")))
+		})
+
+		It("treats unknown, disabled and expired keys as anonymous", func() {
+			for _, key := range []string{"key-unknown", "key-bob", "key-carol"} {
+				id, err := cfg.identify(key, "10.0.0.1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(id).To(Equal(Identity{Key: "10.0.0.1"}))
+			}
+		})
+
+		It("rejects unknown keys when configured", func() {
+			cfg.UnknownKey = UNKNOWN_KEY_REJECT
+			_, err := cfg.identify("key-unknown", "10.0.0.1")
+			Expect(err).To(Equal(errUnknownAPIKey))
+		})
+
+		It("reads the key from the configured header", func() {
+			req, _ := http.NewRequest("GET", "http://example.com/?api_key=key-alice", nil)
+			req.Header.Set(DEFAULT_API_KEY_HEADER, "key-bob")
+			Expect(cfg.keyFrom(req)).To(Equal("key-bob"))
+
+			cfg = &APIKeysConfig{QueryParam: "api_key"}
+			Expect(cfg.validate()).To(Succeed())
+			Expect(cfg.keyFrom(req)).To(Equal("key-alice"))
+		})
+	})
+
+	Describe("KeyRegistry", func() {
+		It("keeps keys managed through the admin endpoints on reload", func() {
+			keyRegistry.Put(&APIKey{Key: "key-alice", Owner: "alice", Tier: "enterprise", Enabled: true, source: keySourceAdmin})
+			keyRegistry.Put(&APIKey{Key: "key-dave", Owner: "dave", Enabled: true, source: keySourceAdmin})
+			keyRegistry.LoadFileKeys(nil)
+
+			Expect(keyRegistry.Get(keyID("key-alice")).Tier).To(Equal("enterprise"))
+			Expect(keyRegistry.Get(keyID("key-dave"))).ToNot(BeNil())
+			Expect(keyRegistry.Get(keyID("key-bob"))).To(BeNil())
+		})
+
+		It("rejects keys whose id is taken by a different key", func() {
+			Expect(keyID("key-alice")).To(HaveLen(32))
+			keyRegistry.keys[keyID("key-erin")] = &APIKey{Key: "key-frank", Owner: "frank", Enabled: true}
+			defer keyRegistry.Delete(keyID("key-erin"))
+			Expect(keyRegistry.Put(&APIKey{Key: "key-erin", Owner: "erin", Enabled: true})).To(MatchError(ContainSubstring("collides")))
+			Expect(keyRegistry.Get(keyID("key-erin")).Owner).To(Equal("frank"))
+			Expect(keyRegistry.Put(&APIKey{Key: "key-frank", Owner: "frank", Tier: "pro", Enabled: true})).ToNot(HaveOccurred())
+			keyRegistry.Delete(keyID("key-frank"))
+		})
+
+		It("reports usage per key", func() {
+			keyRegistry.Record(keyID("key-alice"), false)
+			keyRegistry.Record(keyID("key-alice"), true)
+
+			usage := keyRegistry.Usage()
+			Expect(usage).To(HaveLen(3))
+			Expect(usage[0].Owner).To(Equal("alice"))
+			Expect(usage[0].Requests).To(Equal(int64(2)))
+			Expect(usage[0].Rejected).To(Equal(int64(1)))
+			Expect(usage[0].LastUsed).ToNot(BeNil())
+		})
+	})
+
+	Describe("admin endpoints", func() {
+		BeforeEach(func() {
+			os.Setenv("ADMIN_TOKEN", "t0k3n")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("ADMIN_TOKEN")
+		})
+
+		serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer t0k3n")
+			rec := httptest.NewRecorder()
+			adminOnly(apiKeysHandler)(rec, req)
+			return rec
+		}
+
+		It("creates, updates and deletes keys", func() {
+			rec := serve("POST", "/api-keys", `{"owner": "erin", "tier": "free"}`)
+			Expect(rec.Code).To(Equal(201))
+			var created struct {
+				ID  string `json:"id"`
+				Key string `json:"key"`
+			}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &created)).To(Succeed())
+			Expect(created.Key).ToNot(BeEmpty())
+			Expect(keyRegistry.Get(created.ID).Enabled).To(BeTrue())
+
+			expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			rec = serve("PUT", "/api-keys/"+created.ID, `{"owner": "erin", "limit": 3, "enabled": false, "expires_at": "`+expiry+`"}`)
+			Expect(rec.Code).To(Equal(204))
+			Expect(keyRegistry.Get(created.ID).Limit).To(Equal(3))
+			Expect(keyRegistry.Get(created.ID).Key).To(Equal(created.Key))
+
+			rec = serve("DELETE", "/api-keys/"+created.ID, "")
+			Expect(rec.Code).To(Equal(204))
+			Expect(keyRegistry.Get(created.ID)).To(BeNil())
+		})
+
+		It("validates keys", func() {
+			Expect(serve("POST", "/api-keys", `{"tier": "free"}`).Code).To(Equal(400))
+			Expect(serve("POST", "/api-keys", `{"key": "key-alice", "owner": "mallory"}`).Code).To(Equal(409))
+			Expect(serve("PUT", "/api-keys/unknown", `{"owner": "erin"}`).Code).To(Equal(404))
+		})
+
+		It("requires the admin token", func() {
+			req, _ := http.NewRequest("GET", "/api-keys", nil)
+			rec := httptest.NewRecorder()
+			adminOnly(apiKeysHandler)(rec, req)
+			Expect(rec.Code).To(Equal(401))
+
+			rec = serve("GET", "/api-keys", "")
+			Expect(rec.Code).To(Equal(200))
+			Expect(rec.Body.String()).ToNot(ContainSubstring("key-alice"))
+		})
+
+		It("are disabled without an admin token", func() {
+			os.Unsetenv("ADMIN_TOKEN")
+			Expect(serve("POST", "/api-keys", `{"owner": "mallory", "tier": "enterprise"}`).Code).To(Equal(403))
+		})
+	})
+})
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half-open"
+
+	DEFAULT_CONSECUTIVE_FAILURES = 5
+	DEFAULT_BREAKER_WINDOW       = 10 //Seconds
+	DEFAULT_MIN_REQUESTS         = 20
+	DEFAULT_OPEN_DURATION        = 30 //Seconds
+	DEFAULT_HALF_OPEN_REQUESTS   = 1
+
+	BREAKER_IDLE_TTL = 5 * time.Minute //Closed breakers of hosts without requests are dropped after it
+)
+
+var circuitBreakers = NewBreakerRegistry()
+
+//BreakerConfig trips a circuit breaker per destination host when the upstream
+//keeps failing, requests are answered with 503 without being forwarded while
+//it is open. Failures are transport errors, timeouts and failure statuses.
+//
+//	circuit_breaker:
+//	  consecutive_failures: 5
+//	  error_rate: 50
+//	  min_requests: 20
+//	  window: 10
+//	  open_duration: 30
+type BreakerConfig struct {
+	ConsecutiveFailures int   `json:"consecutive_failures,omitempty" yaml:"consecutive_failures,omitempty"`
+	ErrorRate           int   `json:"error_rate,omitempty" yaml:"error_rate,omitempty"`       //Percentage of failures in the window, disabled when unset
+	MinRequests         int   `json:"min_requests,omitempty" yaml:"min_requests,omitempty"`   //In the window before the error rate applies
+	Window              int   `json:"window,omitempty" yaml:"window,omitempty"`               //Seconds the error rate is measured over
+	OpenDuration        int   `json:"open_duration,omitempty" yaml:"open_duration,omitempty"` //Seconds before probing the upstream again
+	HalfOpenRequests    int   `json:"half_open_requests,omitempty" yaml:"half_open_requests,omitempty"`
+	FailureStatuses     []int `json:"failure_statuses,omitempty" yaml:"failure_statuses,omitempty"` //Every 5xx when unset
+}
+
+func (c *BreakerConfig) validate() error {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = DEFAULT_CONSECUTIVE_FAILURES
+	}
+	if c.Window == 0 {
+		c.Window = DEFAULT_BREAKER_WINDOW
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = DEFAULT_MIN_REQUESTS
+	}
+	if c.OpenDuration == 0 {
+		c.OpenDuration = DEFAULT_OPEN_DURATION
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = DEFAULT_HALF_OPEN_REQUESTS
+	}
+	if c.ConsecutiveFailures < 0 || c.Window < 0 || c.MinRequests < 0 || c.OpenDuration < 0 || c.HalfOpenRequests < 0 {
+		return errors.New("settings must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 100 {
+		return fmt.Errorf("error_rate must be between 0 and 100, got %d", c.ErrorRate)
+	}
+	for _, status := range c.FailureStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid failure status %d", status)
+		}
+	}
+	return nil
+}
+
+//Returns whether the upstream failed the request. Requests canceled because the
+//client went away are not failures of the upstream.
+func (c *BreakerConfig) failed(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) || req.Context().Err() == nil
+	}
+	if len(c.FailureStatuses) == 0 {
+		return res.StatusCode >= 500
+	}
+	for _, status := range c.FailureStatuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+//Breaker is the circuit breaker of one destination host
+type Breaker struct {
+	host        string
+	state       string
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	probes      int       //Requests in flight while half-open
+	usedAt      time.Time //Guarded by the BreakerRegistry
+	sync.Mutex
+}
+
+//BreakerStat is the state of a breaker reported in /stats/circuit-breakers
+type BreakerStat struct {
+	Host        string     `json:"host"`
+	State       string     `json:"state"`
+	Requests    int        `json:"requests"`
+	Failures    int        `json:"failures"`
+	Consecutive int        `json:"consecutive_failures"`
+	OpenedAt    *time.Time `json:"opened_at,omitempty"`
+}
+
+//Returns whether a request may be forwarded, and how long to wait otherwise
+func (b *Breaker) allow(c *BreakerConfig, now time.Time) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CIRCUIT_OPEN {
+		reopen := b.openedAt.Add(time.Duration(c.OpenDuration) * time.Second)
+		if now.Before(reopen) {
+			return false, reopen.Sub(now)
+		}
+		b.transition(CIRCUIT_HALF_OPEN, now)
+	}
+	if b.state == CIRCUIT_HALF_OPEN {
+		if b.probes >= c.HalfOpenRequests {
+			return false, time.Second
+		}
+		b.probes++
+	}
+	return true, 0
+}
+
+//Records the outcome of a forwarded request
+func (b *Breaker) record(c *BreakerConfig, failed bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CIRCUIT_HALF_OPEN {
+		b.probes--
+		if failed {
+			b.transition(CIRCUIT_OPEN, now)
+		} else {
+			b.transition(CIRCUIT_CLOSED, now)
+		}
+		return
+	}
+	if b.state == CIRCUIT_OPEN {
+		return
+	}
+
+	if now.Sub(b.windowStart) > time.Duration(c.Window)*time.Second {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.consecutive >= c.ConsecutiveFailures ||
+		(c.ErrorRate > 0 && b.requests >= c.MinRequests && b.failures*100 >= c.ErrorRate*b.requests) {
+		b.transition(CIRCUIT_OPEN, now)
+	}
+}
+
+//Releases a request that was allowed but not forwarded
+func (b *Breaker) release() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CIRCUIT_HALF_OPEN && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *Breaker) transition(state string, now time.Time) {
+	log.Printf("Circuit breaker for [%s] %s -> %s (%d of %d requests failed, %d consecutive)\n",
+		b.host, b.state, state, b.failures, b.requests, b.consecutive)
+	b.state = state
+	switch state {
+	case CIRCUIT_OPEN:
+		b.openedAt = now
+		b.probes = 0
+	case CIRCUIT_CLOSED:
+		b.windowStart, b.requests, b.failures, b.consecutive = now, 0, 0, 0
+	}
+}
+
+func (b *Breaker) stat() BreakerStat {
+	b.Lock()
+	defer b.Unlock()
+	s := BreakerStat{Host: b.host, State: b.state, Requests: b.requests, Failures: b.failures, Consecutive: b.consecutive}
+	if b.state != CIRCUIT_CLOSED {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+//BreakerRegistry holds the breakers of the destination hosts
+type BreakerRegistry struct {
+	breakers map[string]*Breaker
+	prunedAt time.Time
+	sync.Mutex
+}
+
+func NewBreakerRegistry() *BreakerRegistry {
+	return &BreakerRegistry{breakers: make(map[string]*Breaker)}
+}
+
+//Returns the breaker of the host, creating it on first use. The forwarded host
+//is chosen by the client, so idle breakers are pruned before creating more.
+func (r *BreakerRegistry) Get(host string) *Breaker {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	b, ok := r.breakers[host]
+	if !ok {
+		if now.Sub(r.prunedAt) > BREAKER_IDLE_TTL {
+			r.prune(now)
+		}
+		b = &Breaker{host: host, state: CIRCUIT_CLOSED, windowStart: now}
+		r.breakers[host] = b
+	}
+	b.usedAt = now
+	return b
+}
+
+//Drops the closed breakers idle longer than the TTL, open ones are kept so
+//that a failing upstream is not probed again early
+func (r *BreakerRegistry) prune(now time.Time) {
+	r.prunedAt = now
+	for host, b := range r.breakers {
+		b.Lock()
+		closed := b.state == CIRCUIT_CLOSED
+		b.Unlock()
+		if closed && now.Sub(b.usedAt) > BREAKER_IDLE_TTL {
+			delete(r.breakers, host)
+		}
+	}
+}
+
+//Returns the state of every breaker, sorted by host
+func (r *BreakerRegistry) Stats() []BreakerStat {
+	r.Lock()
+	r.prune(time.Now())
+	breakers := make([]*Breaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	r.Unlock()
+
+	stats := []BreakerStat{}
+	for _, b := range breakers {
+		stats = append(stats, b.stat())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
+
+func breakerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(circuitBreakers.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
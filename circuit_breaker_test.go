@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	var (
+		cfg     *BreakerConfig
+		breaker *Breaker
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		cfg = &BreakerConfig{ConsecutiveFailures: 3, ErrorRate: 50, MinRequests: 4, OpenDuration: 10}
+		Expect(cfg.validate()).To(Succeed())
+		breaker = NewBreakerRegistry().Get("app.example.com")
+		now = time.Now()
+	})
+
+	It("opens after consecutive failures and probes after the open duration", func() {
+		for i := 0; i < 3; i++ {
+			ok, _ := breaker.allow(cfg, now)
+			Expect(ok).To(BeTrue())
+			breaker.record(cfg, true, now)
+		}
+		Expect(breaker.stat().State).To(Equal(CIRCUIT_OPEN))
+		ok, wait := breaker.allow(cfg, now.Add(4*time.Second))
+		Expect(ok).To(BeFalse())
+		Expect(wait).To(Equal(6 * time.Second))
+
+		later := now.Add(11 * time.Second)
+		ok, _ = breaker.allow(cfg, later)
+		Expect(ok).To(BeTrue())
+		Expect(breaker.stat().State).To(Equal(CIRCUIT_HALF_OPEN))
+		ok, _ = breaker.allow(cfg, later)
+		Expect(ok).To(BeFalse())
+
+		breaker.record(cfg, false, later)
+		Expect(breaker.stat().State).To(Equal(CIRCUIT_CLOSED))
+	})
+
+	It("reopens when the probe fails", func() {
+		for i := 0; i < 3; i++ {
+			breaker.record(cfg, true, now)
+		}
+		later := now.Add(11 * time.Second)
+		breaker.allow(cfg, later)
+		breaker.record(cfg, true, later)
+		stat := breaker.stat()
+		Expect(stat.State).To(Equal(CIRCUIT_OPEN))
+		Expect(*stat.OpenedAt).To(Equal(later))
+	})
+
+	It("opens when the error rate of the window is exceeded", func() {
+		for _, failed := range []bool{false, true, false, true} {
+			breaker.record(cfg, failed, now)
+		}
+		Expect(breaker.stat().State).To(Equal(CIRCUIT_OPEN))
+	})
+
+	It("measures the error rate over the window", func() {
+		breaker.record(cfg, true, now)
+		breaker.record(cfg, false, now)
+		later := now.Add(11 * time.Second)
+		for _, failed := range []bool{false, false, true} {
+			breaker.record(cfg, failed, later)
+		}
+		Expect(breaker.stat()).To(Equal(BreakerStat{Host: "app.example.com", State: CIRCUIT_CLOSED, Requests: 3, Failures: 1, Consecutive: 1}))
+	})
+
+	It("counts errors and failure statuses as failures", func() {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		Expect(cfg.failed(req, nil, errors.New("connection refused"))).To(BeTrue())
+		Expect(cfg.failed(req, &http.Response{StatusCode: 502}, nil)).To(BeTrue())
+		Expect(cfg.failed(req, &http.Response{StatusCode: 404}, nil)).To(BeFalse())
+		cfg.FailureStatuses = []int{429}
+		Expect(cfg.failed(req, &http.Response{StatusCode: 429}, nil)).To(BeTrue())
+		Expect(cfg.failed(req, &http.Response{StatusCode: 500}, nil)).To(BeFalse())
+	})
+
+	It("does not count requests canceled by the client as failures", func() {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		Expect(cfg.failed(req, nil, context.Canceled)).To(BeTrue()) //Canceled upstream, not by the client
+
+		ctx, cancel := context.WithCancel(req.Context())
+		cancel()
+		Expect(cfg.failed(req.WithContext(ctx), nil, fmt.Errorf("dial: %w", context.Canceled))).To(BeFalse())
+	})
+
+	It("prunes breakers idle while closed", func() {
+		registry := NewBreakerRegistry()
+		idle, open := registry.Get("idle.example.com"), registry.Get("open.example.com")
+		open.transition(CIRCUIT_OPEN, now)
+		idle.usedAt = idle.usedAt.Add(-BREAKER_IDLE_TTL - time.Second)
+		open.usedAt = open.usedAt.Add(-BREAKER_IDLE_TTL - time.Second)
+		registry.Get("new.example.com")
+		Expect(registry.Stats()).To(HaveLen(2))
+		Expect(registry.Get("open.example.com") == open).To(BeTrue())
+		Expect(registry.Get("idle.example.com") == idle).To(BeFalse())
+	})
+
+	It("answers with 503 while open without forwarding", func() {
+		forwarded := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded++
+			w.WriteHeader(500)
+		}))
+		defer backend.Close()
+		circuitBreakers = NewBreakerRegistry()
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, CircuitBreaker: cfg}, nil)
+		proxy := newProxy()
+
+		codes := []int{}
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			codes = append(codes, w.Code)
+			if w.Code == 503 {
+				Expect(w.Header().Get("Retry-After")).To(Equal("10"))
+			}
+		}
+		Expect(codes).To(Equal([]int{500, 500, 500, 503, 503}))
+		Expect(forwarded).To(Equal(3))
+		Expect(circuitBreakers.Stats()).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const DEFAULT_COALESCE_MAX_BODY = 1 << 20
+
+var (
+	defaultCoalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+	coalescer = NewCoalescer()
+)
+
+//CoalesceConfig collapses concurrent identical GET requests into one upstream
+//round trip, whose response is shared by all of them. Requests are identical
+//when their URLs and the headers are the same. Requests with credentials are
+//never coalesced, nor are responses shared that are private or set cookies.
+//
+//	coalesce:
+//	  headers: [Accept, Accept-Encoding]
+//	  max_body: 1048576
+type CoalesceConfig struct {
+	Headers []string `json:"headers,omitempty" yaml:"headers,omitempty"`   //Identical requests must agree on, Accept, Accept-Encoding and Accept-Language by default
+	MaxBody int64    `json:"max_body,omitempty" yaml:"max_body,omitempty"` //Bytes of the largest response shared
+}
+
+func (c *CoalesceConfig) validate() error {
+	if len(c.Headers) == 0 {
+		c.Headers = defaultCoalesceHeaders
+	}
+	if c.MaxBody == 0 {
+		c.MaxBody = DEFAULT_COALESCE_MAX_BODY
+	}
+	if c.MaxBody < 0 {
+		return errors.New("max_body must not be negative")
+	}
+	return nil
+}
+
+//Returns whether the request may share the response of an identical one
+func (c *CoalesceConfig) coalescable(req *http.Request) bool {
+	return req.Method == "GET" && (req.Body == nil || req.Body == http.NoBody) && !isUpgrade(req) && !hasSession(req)
+}
+
+//Returns whether the response may be shared by identical requests
+func (c *CoalesceConfig) shareable(res *http.Response) bool {
+	if res.Header.Get("Set-Cookie") != "" || isStream(res) {
+		return false
+	}
+	cc := cacheControl(res.Header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := cc[directive]; ok {
+			return false
+		}
+	}
+	for _, name := range varyHeaders(res.Header) {
+		if !containsFold(c.Headers, name) {
+			return false
+		}
+	}
+	return true
+}
+
+//Coalescer shares the round trips of identical requests in flight
+type Coalescer struct {
+	calls map[string]*call
+	stats CoalesceStats
+	sync.Mutex
+}
+
+//call is the round trip of the first of identical requests
+type call struct {
+	done   chan struct{}
+	shared bool //Whether the response or error is shared, otherwise the others send their own request
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+//CoalesceStats are reported in /stats/coalescing
+type CoalesceStats struct {
+	RoundTrips int64 `json:"round_trips"` //Sent for the first of identical requests
+	Coalesced  int64 `json:"coalesced"`   //Requests that shared a round trip
+	Unshared   int64 `json:"unshared"`    //Requests that waited but sent their own request, as the response could not be shared
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*call)}
+}
+
+func (c *call) response() *http.Response {
+	return &http.Response{
+		StatusCode:    c.status,
+		Header:        c.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+	}
+}
+
+//Sends the request with roundTrip, unless an identical request is in flight,
+//whose response is shared then
+func (c *Coalescer) Do(cfg *CoalesceConfig, req *http.Request, roundTrip func() (*http.Response, error)) (*http.Response, error) {
+	key := cacheKey(req, cfg.Headers)
+	c.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.Unlock()
+		select {
+		case <-cl.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		c.Lock()
+		if cl.shared {
+			c.stats.Coalesced++
+		} else {
+			c.stats.Unshared++
+		}
+		c.Unlock()
+		if !cl.shared {
+			return roundTrip()
+		}
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		return cl.response(), nil
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.stats.RoundTrips++
+	c.Unlock()
+
+	defer func() {
+		c.Lock()
+		delete(c.calls, key)
+		c.Unlock()
+		close(cl.done)
+	}()
+
+	res, err := roundTrip()
+	if err != nil {
+		cl.shared, cl.err = req.Context().Err() == nil, err //Errors of the client going away are not shared
+		return nil, err
+	}
+	if !cfg.shareable(res) || res.ContentLength > cfg.MaxBody {
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, cfg.MaxBody+1))
+	if err != nil || int64(len(body)) > cfg.MaxBody {
+		res.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), res.Body), Closer: res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	cl.shared, cl.status, cl.header, cl.body = true, res.StatusCode, res.Header, body
+	return cl.response(), nil
+}
+
+func (c *Coalescer) Stats() CoalesceStats {
+	c.Lock()
+	defer c.Unlock()
+	return c.stats
+}
+
+func coalesceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(coalescer.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
+
+//Reads the part of a body read ahead, then the rest of it
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+//Sends the request upstream, sharing the round trip with identical requests without credentials when coalescing is enabled
+func (c *Config) coalesce(req *http.Request, roundTrip func() (*http.Response, error)) (*http.Response, error) {
+	if c.Coalesce == nil || !c.Coalesce.coalescable(req) || c.hasCredentials(req) {
+		return roundTrip()
+	}
+	return coalescer.Do(c.Coalesce, req, roundTrip)
+}
+
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Coalescing", func() {
+	var (
+		cfg     *CoalesceConfig
+		backend *httptest.Server
+		release chan struct{}
+		hits    int32
+		cookie  bool
+	)
+
+	BeforeEach(func() {
+		cfg = &CoalesceConfig{}
+		Expect(cfg.validate()).To(Succeed())
+		coalescer = NewCoalescer()
+		release, hits, cookie = make(chan struct{}), 0, false
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			<-release
+			if cookie {
+				w.Header().Set("Set-Cookie", "session=1")
+			}
+			w.Write([]byte("shared"))
+		}))
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, Coalesce: cfg}, nil)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	sendConcurrently := func(n int, header http.Header) []*httptest.ResponseRecorder {
+		proxy := newProxy()
+		recorders := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			recorders[i] = httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL+"/resource")
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			wg.Add(1)
+			go func(w *httptest.ResponseRecorder) {
+				defer wg.Done()
+				proxy.ServeHTTP(w, req)
+			}(recorders[i])
+			if i == 0 {
+				Eventually(func() int32 { return atomic.LoadInt32(&hits) }).Should(Equal(int32(1)))
+			}
+		}
+		time.Sleep(50 * time.Millisecond) //Lets the identical requests join the first
+		close(release)
+		wg.Wait()
+		return recorders
+	}
+
+	It("shares one upstream round trip between identical requests", func() {
+		for _, w := range sendConcurrently(5, nil) {
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("shared"))
+		}
+		Expect(atomic.LoadInt32(&hits)).To(Equal(int32(1)))
+		Expect(coalescer.Stats()).To(Equal(CoalesceStats{RoundTrips: 1, Coalesced: 4}))
+	})
+
+	It("does not share responses setting cookies", func() {
+		cookie = true
+		sendConcurrently(3, nil)
+		Expect(atomic.LoadInt32(&hits)).To(Equal(int32(3)))
+		Expect(coalescer.Stats()).To(Equal(CoalesceStats{RoundTrips: 1, Unshared: 2}))
+	})
+
+	It("does not coalesce requests with credentials", func() {
+		sendConcurrently(3, http.Header{"Authorization": {"Bearer token"}})
+		Expect(atomic.LoadInt32(&hits)).To(Equal(int32(3)))
+		Expect(coalescer.Stats()).To(Equal(CoalesceStats{}))
+	})
+
+	It("does not coalesce requests with API keys", func() {
+		sendConcurrently(3, http.Header{DEFAULT_API_KEY_HEADER: {"secret"}})
+		Expect(atomic.LoadInt32(&hits)).To(Equal(int32(3)))
+		Expect(coalescer.Stats()).To(Equal(CoalesceStats{}))
+	})
+
+	It("only shares responses varying by the configured headers", func() {
+		res := &http.Response{Header: http.Header{"Vary": {"Accept-Encoding"}}}
+		Expect(cfg.shareable(res)).To(BeTrue())
+		res.Header.Set("Vary", "Accept-Encoding, X-Tenant")
+		Expect(cfg.shareable(res)).To(BeFalse())
+		res.Header.Set("Vary", "")
+		res.Header.Set("Cache-Control", "private")
+		Expect(cfg.shareable(res)).To(BeFalse())
+	})
+})
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CONFIG_VERSION  = 1
+	CONFIG_FILE_ENV = "RATE_LIMIT_CONFIG_FILE" //Path to a YAML/JSON rules file
+	CONFIG_ENV      = "RATE_LIMIT_CONFIG"      //Inline YAML/JSON rules, handy with cf push manifests
+	MAX_LIMIT       = 1000                     //The store refills one token per 1000/limit milliseconds
+
+	ACTION_LIMIT  = "limit"  //Apply the limit of the rule (default)
+	ACTION_BLOCK  = "block"  //Reject every matching request
+	ACTION_EXEMPT = "exempt" //Never limit matching requests
+)
+
+//Config is the declarative description of the limits enforced by the service.
+//
+//	version: 1
+//	limit: 10
+//	delay: 0
+//	rules:
+//	  - name: reports
+//	    limit: 2
+//	    match:
+//	      methods: [GET]
+//	      path_prefix: /reports
+type Config struct {
+	Version   int                        `json:"version" yaml:"version"`
+	Limit     int                        `json:"limit" yaml:"limit"`
+	Delay     int                        `json:"delay" yaml:"delay"` //Moved into the default faults by Validate
+	Rules     []Rule                     `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Instances map[string]*InstanceConfig `json:"service_instances,omitempty" yaml:"service_instances,omitempty"`
+
+	//Budgets per forwarded host or host/path-prefix when bound as a user-provided route service
+	PerDestination bool                       `json:"per_destination,omitempty" yaml:"per_destination,omitempty"`
+	Destinations   map[string]*InstanceConfig `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+
+	//Limits per plan tier, applied instead of the default limit to identified clients
+	Tiers map[string]int `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+	JWT   *JWTConfig     `json:"jwt,omitempty" yaml:"jwt,omitempty"`
+
+	APIKeys *APIKeysConfig `json:"api_keys,omitempty" yaml:"api_keys,omitempty"`
+	GeoIP   *GeoIPConfig   `json:"geoip,omitempty" yaml:"geoip,omitempty"`
+
+	//Style of the rate limit headers added to responses: draft, legacy, both (default) or none
+	Headers   string           `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Rejection *RejectionConfig `json:"rejection,omitempty" yaml:"rejection,omitempty"`
+
+	Signature         *SignatureConfig   `json:"route_service_signature,omitempty" yaml:"route_service_signature,omitempty"`
+	DestinationPolicy *DestinationPolicy `json:"destination_policy,omitempty" yaml:"destination_policy,omitempty"`
+	UpstreamTLS       *UpstreamTLS       `json:"upstream_tls,omitempty" yaml:"upstream_tls,omitempty"`
+	Upstream          *TransportConfig   `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+
+	Faults         *FaultConfig   `json:"faults,omitempty" yaml:"faults,omitempty"`
+	CircuitBreaker *BreakerConfig `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+	Retries        *RetryConfig   `json:"retries,omitempty" yaml:"retries,omitempty"`
+
+	LoadShedding *LoadSheddingConfig `json:"load_shedding,omitempty" yaml:"load_shedding,omitempty"`
+	FairQueue    *FairQueueConfig    `json:"fair_queue,omitempty" yaml:"fair_queue,omitempty"`
+	StaleCache   *StaleCacheConfig   `json:"stale_cache,omitempty" yaml:"stale_cache,omitempty"`
+	Coalesce     *CoalesceConfig     `json:"coalesce,omitempty" yaml:"coalesce,omitempty"`
+	Streaming    *StreamingConfig    `json:"streaming,omitempty" yaml:"streaming,omitempty"`
+
+	Server   *ServerConfig   `json:"server,omitempty" yaml:"server,omitempty"`
+	TLS      *ServerTLS      `json:"tls,omitempty" yaml:"tls,omitempty"`
+	Shutdown *ShutdownConfig `json:"shutdown,omitempty" yaml:"shutdown,omitempty"`
+}
+
+//InstanceConfig overrides the defaults for one service instance, or for one
+//binding of it, in brokered mode, or for one destination. Unset fields inherit
+//from the enclosing level.
+//
+//	service_instances:
+//	  8d5e4a8c-...:
+//	    limit: 50
+//	    per_binding: true
+//	    bindings:
+//	      0b1f3e2a-...:
+//	        limit: 5
+type InstanceConfig struct {
+	Limit      int                        `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Delay      *int                       `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Rules      []Rule                     `json:"rules,omitempty" yaml:"rules,omitempty"`
+	PerBinding bool                       `json:"per_binding,omitempty" yaml:"per_binding,omitempty"`
+	Bindings   map[string]*InstanceConfig `json:"bindings,omitempty" yaml:"bindings,omitempty"`
+}
+
+//Rule applies its own limit to the requests it matches, or blocks or exempts them.
+//Rules are evaluated in order and the first match wins, requests matching no
+//rule use the default limit.
+type Rule struct {
+	Name   string `json:"name" yaml:"name"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	Limit  int    `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Status int    `json:"status,omitempty" yaml:"status,omitempty"` //Of rejections, 429 or 503 for limits and a 4xx for blocks
+	Match  Match  `json:"match" yaml:"match"`
+
+	Upstream *TransportConfig `json:"upstream,omitempty" yaml:"upstream,omitempty"` //Overrides of the upstream transport settings
+	Faults   *FaultConfig     `json:"faults,omitempty" yaml:"faults,omitempty"`     //Replaces the default faults
+	Retries  *RetryConfig     `json:"retries,omitempty" yaml:"retries,omitempty"`   //Replaces the default retries
+	Priority string           `json:"priority,omitempty" yaml:"priority,omitempty"` //Of the requests for load shedding
+	MaxBody  int64            `json:"max_body,omitempty" yaml:"max_body,omitempty"` //Bytes of request bodies, overrides the server limit
+}
+
+//Match selects requests by the forwarded URL, headers and the GeoIP data of the
+//client. Empty fields match everything.
+type Match struct {
+	Methods    []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Countries  []string          `json:"countries,omitempty" yaml:"countries,omitempty"`
+	ASNs       []uint            `json:"asns,omitempty" yaml:"asns,omitempty"`
+	//gRPC calls to package.Service/Method, or to any method of package.Service
+	GRPCMethods []string `json:"grpc_methods,omitempty" yaml:"grpc_methods,omitempty"`
+}
+
+//Parses a JSON or YAML document and validates the result
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("invalid json config: %s", err)
+		}
+	} else if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid yaml config: %s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+//Validates the config and loads the files it refers to
+func (c *Config) Validate() error {
+	if c.Version != CONFIG_VERSION {
+		return fmt.Errorf("unsupported config version %d, expected %d", c.Version, CONFIG_VERSION)
+	}
+	if err := validateLimit(c.Limit); err != nil {
+		return err
+	}
+	if c.Delay < 0 {
+		return errors.New("delay must not be negative")
+	}
+	switch c.Headers {
+	case "", HEADERS_DRAFT, HEADERS_LEGACY, HEADERS_BOTH, HEADERS_NONE:
+	default:
+		return fmt.Errorf("headers must be one of %q, %q, %q or %q", HEADERS_DRAFT, HEADERS_LEGACY, HEADERS_BOTH, HEADERS_NONE)
+	}
+	if err := validateRules(c.Rules); err != nil {
+		return err
+	}
+
+	for id, instance := range c.Instances {
+		if err := instance.validate(true); err != nil {
+			return fmt.Errorf("service instance %s: %s", id, err)
+		}
+		for bindingID, binding := range instance.Bindings {
+			if err := binding.validate(false); err != nil {
+				return fmt.Errorf("service instance %s binding %s: %s", id, bindingID, err)
+			}
+		}
+	}
+	for key, destination := range c.Destinations {
+		if key == "" || strings.HasPrefix(key, "/") {
+			return fmt.Errorf("destination %q must start with a host", key)
+		}
+		if err := destination.validate(false); err != nil {
+			return fmt.Errorf("destination %s: %s", key, err)
+		}
+	}
+	for tier, limit := range c.Tiers {
+		if err := validateLimit(limit); err != nil {
+			return fmt.Errorf("tier %s: %s", tier, err)
+		}
+	}
+	if c.JWT != nil {
+		if err := c.JWT.validate(c.Tiers); err != nil {
+			return fmt.Errorf("jwt: %s", err)
+		}
+	}
+	if c.APIKeys != nil {
+		if err := c.APIKeys.validate(); err != nil {
+			return fmt.Errorf("api_keys: %s", err)
+		}
+	}
+	if c.Signature != nil {
+		if err := c.Signature.validate(); err != nil {
+			return fmt.Errorf("route_service_signature: %s", err)
+		}
+	}
+	if c.DestinationPolicy != nil {
+		if err := c.DestinationPolicy.validate(); err != nil {
+			return fmt.Errorf("destination_policy: %s", err)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			return fmt.Errorf("circuit_breaker: %s", err)
+		}
+	}
+	if c.Faults != nil {
+		if err := c.Faults.validate(); err != nil {
+			return fmt.Errorf("faults: %s", err)
+		}
+	}
+	if c.Delay > 0 { //The legacy delay, set by DURATION, becomes a default fault
+		if c.Faults != nil && c.Faults.Delay != nil {
+			return errors.New("delay cannot be combined with faults.delay, move it to the faults")
+		}
+		c.Faults, c.Delay = c.Faults.withDelay(c.Delay), 0
+	}
+	if c.Retries != nil {
+		if err := c.Retries.validate(); err != nil {
+			return fmt.Errorf("retries: %s", err)
+		}
+	}
+	if c.LoadShedding != nil {
+		if err := c.LoadShedding.validate(); err != nil {
+			return fmt.Errorf("load_shedding: %s", err)
+		}
+	}
+	if c.FairQueue != nil {
+		if err := c.FairQueue.validate(); err != nil {
+			return fmt.Errorf("fair_queue: %s", err)
+		}
+	}
+	if c.StaleCache != nil {
+		if err := c.StaleCache.validate(); err != nil {
+			return fmt.Errorf("stale_cache: %s", err)
+		}
+	}
+	if c.Coalesce != nil {
+		if err := c.Coalesce.validate(); err != nil {
+			return fmt.Errorf("coalesce: %s", err)
+		}
+	}
+	if c.Streaming != nil {
+		if err := c.Streaming.validate(); err != nil {
+			return fmt.Errorf("streaming: %s", err)
+		}
+	}
+	if c.Server != nil {
+		if err := c.Server.validate(); err != nil {
+			return fmt.Errorf("server: %s", err)
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+	if c.Shutdown != nil {
+		if err := c.Shutdown.validate(); err != nil {
+			return fmt.Errorf("shutdown: %s", err)
+		}
+	}
+	if c.Upstream != nil {
+		if err := c.Upstream.validate(); err != nil {
+			return fmt.Errorf("upstream: %s", err)
+		}
+	}
+	if c.UpstreamTLS != nil {
+		if err := c.UpstreamTLS.validate(); err != nil {
+			return fmt.Errorf("upstream_tls: %s", err)
+		}
+	}
+	if c.Rejection != nil {
+		if err := c.Rejection.validate(); err != nil {
+			return fmt.Errorf("rejection: %s", err)
+		}
+	}
+	if c.GeoIP != nil {
+		if err := c.GeoIP.validate(); err != nil {
+			return fmt.Errorf("geoip: %s", err)
+		}
+	} else {
+		for _, rule := range c.allRules() {
+			if len(rule.Match.Countries) > 0 || len(rule.Match.ASNs) > 0 {
+				return fmt.Errorf("rule %q matches on countries or asns but geoip is not configured", rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+//Returns the rules of every level of the config
+func (c *Config) allRules() []Rule {
+	rules := append([]Rule{}, c.Rules...)
+	for _, instance := range c.Instances {
+		rules = append(rules, instance.Rules...)
+		for _, binding := range instance.Bindings {
+			rules = append(rules, binding.Rules...)
+		}
+	}
+	for _, destination := range c.Destinations {
+		rules = append(rules, destination.Rules...)
+	}
+	return rules
+}
+
+//Returns the files the config refers to, these are watched for changes with the config file
+func (c *Config) files() []string {
+	var files []string
+	if c.JWT != nil && c.JWT.JWKSFile != "" {
+		files = append(files, c.JWT.JWKSFile)
+	}
+	if c.APIKeys != nil && c.APIKeys.File != "" {
+		files = append(files, c.APIKeys.File)
+	}
+	if c.GeoIP != nil {
+		files = append(files, c.GeoIP.Databases...)
+	}
+	if c.Rejection != nil && c.Rejection.HTMLTemplate != "" {
+		files = append(files, c.Rejection.HTMLTemplate)
+	}
+	if c.UpstreamTLS != nil {
+		files = append(files, c.UpstreamTLS.files()...)
+	}
+	if c.TLS != nil {
+		files = append(files, c.TLS.files()...)
+	}
+	return files
+}
+
+func (ic *InstanceConfig) validate(allowBindings bool) error {
+	if ic == nil {
+		return errors.New("empty config")
+	}
+	if ic.Limit != 0 {
+		if err := validateLimit(ic.Limit); err != nil {
+			return err
+		}
+	}
+	if ic.Delay != nil && *ic.Delay < 0 {
+		return errors.New("delay must not be negative")
+	}
+	if !allowBindings && (ic.PerBinding || len(ic.Bindings) > 0) {
+		return errors.New("bindings can only be configured on a service instance")
+	}
+	return validateRules(ic.Rules)
+}
+
+func validateRules(rules []Rule) error {
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.Action {
+		case "", ACTION_LIMIT:
+			if err := validateLimit(rule.Limit); err != nil {
+				return fmt.Errorf("rule %q: %s", rule.Name, err)
+			}
+			if rule.Status != 0 && rule.Status != http.StatusTooManyRequests && rule.Status != http.StatusServiceUnavailable {
+				return fmt.Errorf("rule %q: status must be 429 or 503", rule.Name)
+			}
+		case ACTION_BLOCK:
+			if rule.Status != 0 && (rule.Status < 400 || rule.Status > 499) {
+				return fmt.Errorf("rule %q: status must be a 4xx", rule.Name)
+			}
+		case ACTION_EXEMPT:
+		default:
+			return fmt.Errorf("rule %q: unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Match.PathPrefix != "" && !strings.HasPrefix(rule.Match.PathPrefix, "/") {
+			return fmt.Errorf("rule %q: path_prefix must start with /", rule.Name)
+		}
+		for _, method := range rule.Match.GRPCMethods {
+			if err := validateGRPCMethod(method); err != nil {
+				return fmt.Errorf("rule %q: %s", rule.Name, err)
+			}
+		}
+		if rule.Upstream != nil {
+			if err := rule.Upstream.validate(); err != nil {
+				return fmt.Errorf("rule %q: upstream: %s", rule.Name, err)
+			}
+		}
+		if rule.Faults != nil {
+			if err := rule.Faults.validate(); err != nil {
+				return fmt.Errorf("rule %q: faults: %s", rule.Name, err)
+			}
+		}
+		if rule.Retries != nil {
+			if err := rule.Retries.validate(); err != nil {
+				return fmt.Errorf("rule %q: retries: %s", rule.Name, err)
+			}
+		}
+		if rule.MaxBody < 0 {
+			return fmt.Errorf("rule %q: max_body must not be negative", rule.Name)
+		}
+		if rule.Priority != "" {
+			if err := validatePriority(rule.Priority); err != nil {
+				return fmt.Errorf("rule %q: %s", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateLimit(limit int) error {
+	if limit < 1 || limit > MAX_LIMIT {
+		return fmt.Errorf("limit must be between 1 and %d, got %d", MAX_LIMIT, limit)
+	}
+	return nil
+}
+
+//Returns the first rule matching the request, or nil
+func (c *Config) MatchRule(req *http.Request) *Rule {
+	return matchRule(c.Rules, req)
+}
+
+func matchRule(rules []Rule, req *http.Request) *Rule {
+	for i := range rules {
+		if rules[i].Match.Matches(req) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (m *Match) Matches(req *http.Request) bool {
+	if len(m.Methods) > 0 && !containsFold(m.Methods, req.Method) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !containsFold(m.Hosts, hostWithoutPort(req.URL.Host)) {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, m.PathPrefix) {
+		return false
+	}
+	for name, value := range m.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	if len(m.Countries) > 0 && !containsFold(m.Countries, geoFrom(req).Country) {
+		return false
+	}
+	if len(m.ASNs) > 0 && !containsASN(m.ASNs, geoFrom(req).ASN) {
+		return false
+	}
+	if len(m.GRPCMethods) > 0 && !matchesGRPC(m.GRPCMethods, req) {
+		return false
+	}
+	return true
+}
+
+func containsASN(asns []uint, asn uint) bool {
+	for _, a := range asns {
+		if a == asn {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostWithoutPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+
+	Describe("ParseConfig", func() {
+
+		It("parses yaml", func() {
+			cfg, err := ParseConfig([]byte(`
+version: 1
+limit: 10
+delay: 5
+rules:
+  - name: reports
+    limit: 2
+    match:
+      methods: [GET]
+      path_prefix: /reports
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Limit).To(Equal(10))
+			Expect(cfg.Faults.Delay).To(Equal(&DelayFault{Fixed: 5, Phase: PHASE_AFTER}))
+			Expect(cfg.Rules).To(HaveLen(1))
+			Expect(cfg.Rules[0].Match.PathPrefix).To(Equal("/reports"))
+		})
+
+		It("parses json", func() {
+			cfg, err := ParseConfig([]byte(`{"version": 1, "limit": 3, "rules": [{"name": "api", "limit": 1, "match": {"hosts": ["api.example.com"]}}]}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Limit).To(Equal(3))
+			Expect(cfg.Rules[0].Match.Hosts).To(ConsistOf("api.example.com"))
+		})
+
+		It("rejects unknown fields", func() {
+			_, err := ParseConfig([]byte(`{"version": 1, "limit": 3, "limt": 4}`))
+			Expect(err).To(HaveOccurred())
+			_, err = ParseConfig([]byte("version: 1\nlimit: 3\nlimt: 4\n"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects unsupported versions", func() {
+			_, err := ParseConfig([]byte("version: 2\nlimit: 3\n"))
+			Expect(err).To(MatchError(ContainSubstring("unsupported config version")))
+		})
+
+		It("rejects invalid rules", func() {
+			_, err := ParseConfig([]byte("version: 1\nlimit: 3\nrules:\n  - name: a\n    limit: 0\n"))
+			Expect(err).To(HaveOccurred())
+			_, err = ParseConfig([]byte("version: 1\nlimit: 3\nrules:\n  - name: a\n    limit: 1\n  - name: a\n    limit: 1\n"))
+			Expect(err).To(MatchError(ContainSubstring("duplicate rule name")))
+		})
+	})
+
+	Describe("MatchRule", func() {
+		var cfg *Config
+
+		BeforeEach(func() {
+			cfg = &Config{
+				Version: CONFIG_VERSION,
+				Limit:   10,
+				Rules: []Rule{
+					{Name: "post-reports", Limit: 1, Match: Match{Methods: []string{"POST"}, PathPrefix: "/reports"}},
+					{Name: "api", Limit: 2, Match: Match{Hosts: []string{"api.example.com"}}},
+				},
+			}
+		})
+
+		It("returns the first matching rule", func() {
+			req, _ := http.NewRequest("POST", "http://api.example.com:8080/reports/1", nil)
+			Expect(cfg.MatchRule(req).Name).To(Equal("post-reports"))
+
+			req, _ = http.NewRequest("GET", "http://api.example.com:8080/reports/1", nil)
+			Expect(cfg.MatchRule(req).Name).To(Equal("api"))
+		})
+
+		It("returns nil when no rule matches", func() {
+			req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+			Expect(cfg.MatchRule(req)).To(BeNil())
+		})
+	})
+
+	Describe("loadConfig", func() {
+		It("falls back to the legacy env vars and their defaults", func() {
+			os.Setenv("RATE_LIMIT", "20")
+			defer os.Unsetenv("RATE_LIMIT")
+			cfg, err := loadConfig()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Limit).To(Equal(20))
+			Expect(cfg.Faults).To(BeNil()) //No DURATION, no delay
+		})
+	})
+
+	Describe("updateConfig", func() {
+		It("keeps concurrent overrides and drops them on reload", func() {
+			os.Setenv("RATE_LIMIT", "20")
+			defer os.Unsetenv("RATE_LIMIT")
+			rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10}, nil)
+
+			reading, release, done := make(chan bool), make(chan bool), make(chan bool)
+			go func() {
+				updateConfig(func(c *Config) *Config {
+					close(reading)
+					<-release
+					return c.withOverride(Scope{Destination: "a.example.com"}, 1, nil)
+				})
+			}()
+			<-reading
+			go func() {
+				onTheFlyConfig(httptest.NewRecorder(), httptest.NewRequest("GET", "/config?destination=b.example.com&LIMIT=2", nil))
+				close(done)
+			}()
+			Consistently(done).ShouldNot(BeClosed()) //Waits for the update in progress
+			close(release)
+			Eventually(done).Should(BeClosed())
+			Expect(currentRateLimiter().Config().Destinations).To(HaveKey("a.example.com"))
+			Expect(currentRateLimiter().Config().Destinations).To(HaveKey("b.example.com"))
+
+			reloadConfig()
+			Expect(currentRateLimiter().Config().Destinations).To(BeEmpty())
+			Expect(currentRateLimiter().Config().Limit).To(Equal(20))
+		})
+	})
+})
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_CONFIG_POLL = 5 //Seconds between checks of the rules file
+
+var limiterMu sync.RWMutex
+
+//Serializes config changes, so updates from the admin APIs and reloads are not lost
+//in between reading the current config and applying the changed one
+var (
+	configMu   sync.Mutex
+	overridden bool //The current config has runtime overrides, which a reload discards
+)
+
+func currentRateLimiter() *RateLimiter {
+	limiterMu.RLock()
+	defer limiterMu.RUnlock()
+	return rateLimiter
+}
+
+//Atomically swaps the active RateLimiter for one built from cfg
+func applyConfig(cfg *Config) {
+	limiterMu.Lock()
+	previous := rateLimiter
+	rateLimiter = NewRateLimiterFromConfig(cfg, previous)
+	next := rateLimiter
+	limiterMu.Unlock()
+
+	if previous != nil {
+		previous.Release(next)
+	}
+	upstreamTransports.retain(cfg.transportKeys())
+	if cfg.APIKeys != nil {
+		keyRegistry.LoadFileKeys(cfg.APIKeys.keys)
+	} else {
+		keyRegistry.LoadFileKeys(nil)
+	}
+	log.Printf("Applied config: limit [%d], %d rules\n", cfg.Limit, len(cfg.Rules))
+}
+
+//Reads the config from RATE_LIMIT_CONFIG_FILE, RATE_LIMIT_CONFIG or the legacy env vars
+func loadConfig() (*Config, error) {
+	if path := os.Getenv(CONFIG_FILE_ENV); path != "" {
+		return LoadConfigFile(path)
+	}
+	if inline := os.Getenv(CONFIG_ENV); inline != "" {
+		return ParseConfig([]byte(inline))
+	}
+	cfg := &Config{
+		Version: CONFIG_VERSION,
+		Limit:   getEnv("RATE_LIMIT", DEFAULT_LIMIT),
+		Delay:   getEnv("DURATION", DEFAULT_DURATION),
+	}
+	return cfg, cfg.Validate()
+}
+
+//Applies a change to the current config, such as an override from /config or /faults.
+//Overrides last until the next reload.
+func updateConfig(change func(*Config) *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	applyConfig(change(currentRateLimiter().Config()))
+	overridden = true
+}
+
+func reloadConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Printf("Config reload failed, keeping current config: %s\n", err)
+		return
+	}
+	if overridden {
+		log.Printf("Reloading config, discarding the overrides made through /config and /faults")
+	}
+	applyConfig(cfg)
+	overridden = false
+}
+
+//Reloads the config on SIGHUP and whenever the rules file, or a file it refers
+//to such as a GeoIP database, changes
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	path := os.Getenv(CONFIG_FILE_ENV)
+	changes := watchFiles(func() []string {
+		files := currentRateLimiter().Config().files()
+		if path != "" {
+			files = append(files, path)
+		}
+		return files
+	}, time.Duration(getEnv("RATE_LIMIT_CONFIG_POLL", DEFAULT_CONFIG_POLL))*time.Second)
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Printf("Received SIGHUP, reloading config")
+			case changed := <-changes:
+				log.Printf("File %s changed, reloading config", changed)
+			}
+			reloadConfig()
+		}
+	}()
+}
+
+//Polls the files and signals the path of any file whose modification time or
+//size changes. The list of files is re-read on every poll.
+func watchFiles(paths func() []string, interval time.Duration) <-chan string {
+	changes := make(chan string)
+	infos := make(map[string]os.FileInfo)
+	for _, path := range paths() {
+		infos[path], _ = os.Stat(path)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			for _, path := range paths() {
+				current, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				info, seen := infos[path]
+				infos[path] = current
+				if !seen {
+					continue
+				}
+				if info == nil || !current.ModTime().Equal(info.ModTime()) || current.Size() != info.Size() {
+					changes <- path
+					break
+				}
+			}
+		}
+	}()
+	return changes
+}
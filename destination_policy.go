@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	REJECTED_SCHEME  = "scheme"
+	REJECTED_PORT    = "port"
+	REJECTED_HOST    = "host"
+	REJECTED_ADDRESS = "address"
+)
+
+var (
+	policyUsage = NewPolicyStats()
+
+	//Ranges never forwarded to unless listed in allowed_networks, on top of
+	//the private, loopback, link-local and unspecified ranges
+	deniedNetworks = parseCIDRs("100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "64:ff9b::/96")
+)
+
+//DestinationPolicy restricts the destinations requests are forwarded to, so the
+//forwarded URL cannot be used to reach internal services or metadata endpoints.
+//
+//	destination_policy:
+//	  allowed_hosts: [example.com, .apps.example.com]
+//	  allowed_schemes: [https]
+//	  allowed_ports: [443]
+//	  allowed_networks: [10.10.0.0/16]
+type DestinationPolicy struct {
+	AllowedHosts    []string `json:"allowed_hosts,omitempty" yaml:"allowed_hosts,omitempty"` //Hosts, or domain suffixes starting with a dot. Empty allows every host
+	AllowedSchemes  []string `json:"allowed_schemes,omitempty" yaml:"allowed_schemes,omitempty"`
+	AllowedPorts    []int    `json:"allowed_ports,omitempty" yaml:"allowed_ports,omitempty"`       //Empty allows every port
+	AllowedNetworks []string `json:"allowed_networks,omitempty" yaml:"allowed_networks,omitempty"` //Private ranges that may be forwarded to
+	AllowPrivate    bool     `json:"allow_private,omitempty" yaml:"allow_private,omitempty"`       //Disables the checks of resolved addresses
+
+	networks []*net.IPNet
+}
+
+//PolicyError is a destination rejected by the policy
+type PolicyError struct {
+	Reason string
+	Detail string
+}
+
+func (e *PolicyError) Error() string {
+	return "destination not allowed: " + e.Detail
+}
+
+//Validates the settings and parses the allowed networks
+func (p *DestinationPolicy) validate() error {
+	if len(p.AllowedSchemes) == 0 {
+		p.AllowedSchemes = []string{"http", "https"}
+	}
+	for _, scheme := range p.AllowedSchemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme %q", scheme)
+		}
+	}
+	for _, port := range p.AllowedPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, host := range p.AllowedHosts {
+		if host == "" || host == "." {
+			return errors.New("allowed_hosts must not contain empty hosts")
+		}
+	}
+	p.networks = nil
+	for _, cidr := range p.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", cidr)
+		}
+		p.networks = append(p.networks, network)
+	}
+	return nil
+}
+
+//Checks the scheme, port and host of the destination, and its address when the host
+//is an IP. The addresses names resolve to are checked by dialControl when connecting,
+//so requests do not cost a DNS lookup before they are limited.
+func (p *DestinationPolicy) Check(u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	if !containsFold(p.AllowedSchemes, u.Scheme) {
+		return &PolicyError{REJECTED_SCHEME, fmt.Sprintf("scheme %q", u.Scheme)}
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if !p.allowedPort(port) {
+		return &PolicyError{REJECTED_PORT, "port " + port}
+	}
+	host := strings.ToLower(u.Hostname())
+	if !p.allowedHost(host) {
+		return &PolicyError{REJECTED_HOST, "host " + host}
+	}
+	if p.AllowPrivate {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+func (p *DestinationPolicy) allowedPort(port string) bool {
+	if len(p.AllowedPorts) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedPorts {
+		if strconv.Itoa(allowed) == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DestinationPolicy) allowedHost(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, ".") {
+			if strings.HasSuffix(host, allowed) || host == allowed[1:] {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DestinationPolicy) checkIP(ip net.IP) error {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return &PolicyError{REJECTED_ADDRESS, "address " + ip.String()}
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return &PolicyError{REJECTED_ADDRESS, "address " + ip.String()}
+		}
+	}
+	return nil
+}
+
+//Checks the address of every upstream connection, so a host cannot resolve to
+//an allowed address when checked and to a denied one when connected to
+func dialControl(network, address string, c syscall.RawConn) error {
+	policy := currentRateLimiter().Config().DestinationPolicy
+	if policy == nil || policy.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := policy.checkIP(ip); err != nil {
+			policyUsage.Record(err.(*PolicyError).Reason)
+			return err
+		}
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//PolicyStats counts the destinations rejected by the policy by reason, reported in /stats/destinations
+type PolicyStats struct {
+	Rejected map[string]int64 `json:"rejected"`
+	sync.Mutex
+}
+
+func NewPolicyStats() *PolicyStats {
+	return &PolicyStats{Rejected: make(map[string]int64)}
+}
+
+func (s *PolicyStats) Record(reason string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Rejected[reason]++
+}
+
+func policyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	policyUsage.Lock()
+	stats, err := json.Marshal(policyUsage)
+	policyUsage.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
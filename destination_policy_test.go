@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Destination policy", func() {
+	var policy *DestinationPolicy
+
+	BeforeEach(func() {
+		policy = &DestinationPolicy{
+			AllowedHosts:    []string{"example.com", ".apps.example.com", "10.10.0.5", "internal.example.com"},
+			AllowedSchemes:  []string{"https"},
+			AllowedPorts:    []int{443, 8443},
+			AllowedNetworks: []string{"10.10.0.0/16"},
+		}
+		Expect(policy.validate()).To(Succeed())
+	})
+
+	reason := func(rawURL string) string {
+		u, err := url.Parse(rawURL)
+		Expect(err).ToNot(HaveOccurred())
+		if err := policy.Check(u); err != nil {
+			return err.(*PolicyError).Reason
+		}
+		return ""
+	}
+
+	It("allows listed hosts and domain suffixes", func() {
+		Expect(reason("https://example.com/")).To(BeEmpty())
+		Expect(reason("https://app.apps.example.com:8443/")).To(BeEmpty())
+		Expect(reason("https://10.10.0.5/")).To(BeEmpty())
+		Expect(reason("https://evil.com/")).To(Equal(REJECTED_HOST))
+		Expect(reason("https://notexample.com/")).To(Equal(REJECTED_HOST))
+	})
+
+	It("rejects schemes and ports that are not allowed", func() {
+		Expect(reason("http://example.com/")).To(Equal(REJECTED_SCHEME))
+		Expect(reason("https://example.com:22/")).To(Equal(REJECTED_PORT))
+	})
+
+	It("rejects private or link-local addresses", func() {
+		Expect(reason("https://internal.example.com/")).To(BeEmpty()) //Its addresses are checked when connecting
+
+		policy.AllowedHosts = nil
+		Expect(reason("https://169.254.169.254/")).To(Equal(REJECTED_ADDRESS))
+		Expect(reason("https://127.0.0.1/")).To(Equal(REJECTED_ADDRESS))
+		Expect(reason("https://[::1]/")).To(Equal(REJECTED_ADDRESS))
+		Expect(reason("https://100.64.0.1/")).To(Equal(REJECTED_ADDRESS))
+
+		policy.AllowPrivate = true
+		Expect(reason("https://127.0.0.1/")).To(BeEmpty())
+	})
+
+	It("checks every upstream connection", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10, DestinationPolicy: policy}, nil)
+		Expect(dialControl("tcp", "169.254.169.254:80", nil)).To(HaveOccurred())
+		Expect(dialControl("tcp", "10.10.0.5:443", nil)).To(Succeed())
+	})
+
+	It("answers with 403 when a host resolves to a denied address", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10, DestinationPolicy: &DestinationPolicy{}}, nil)
+		Expect(rateLimiter.Config().Validate()).To(Succeed())
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		before := policyUsage.Rejected[REJECTED_ADDRESS]
+
+		req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+		req.Header.Set(CF_FORWARDED_URL, strings.Replace(backend.URL, "127.0.0.1", "localhost", 1))
+		w := httptest.NewRecorder()
+		newProxy().ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		Expect(policyUsage.Rejected[REJECTED_ADDRESS]).To(BeNumerically(">", before))
+	})
+
+	It("rejects and counts forbidden destinations before forwarding", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10, DestinationPolicy: &DestinationPolicy{}}, nil)
+		Expect(rateLimiter.Config().Validate()).To(Succeed())
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		before := policyUsage.Rejected[REJECTED_ADDRESS]
+
+		req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+		req.Header.Set(CF_FORWARDED_URL, backend.URL)
+		w := httptest.NewRecorder()
+		newProxy().ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		Expect(policyUsage.Rejected[REJECTED_ADDRESS]).To(Equal(before + 1))
+	})
+
+	It("validates the settings", func() {
+		Expect((&DestinationPolicy{AllowedSchemes: []string{"ftp"}}).validate()).To(HaveOccurred())
+		Expect((&DestinationPolicy{AllowedPorts: []int{0}}).validate()).To(HaveOccurred())
+		Expect((&DestinationPolicy{AllowedNetworks: []string{"10.0.0.0"}}).validate()).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_QUEUE     = 1000
+	DEFAULT_QUEUE_TIMEOUT = 10 //Seconds
+
+	QUEUE_STATS_TTL   = 5 * time.Minute //Idle clients are dropped from the stats after it
+	MAX_QUEUE_CLIENTS = 10000           //Clients kept in the stats
+)
+
+var (
+	errQueueFull    = errors.New("admission queue is full")
+	errQueueTimeout = errors.New("timed out in the admission queue")
+
+	fairQueue = NewFairQueue()
+)
+
+//FairQueueConfig queues requests once concurrency requests are in flight to
+//upstreams, and admits them fairly across clients by deficit round robin: every
+//client with queued requests is admitted weight requests in turn, so one heavy
+//client cannot starve many light ones. Weights are per tier, 1 by default.
+//
+//	fair_queue:
+//	  concurrency: 100
+//	  max_queue: 1000
+//	  timeout: 10
+//	  weights:
+//	    enterprise: 4
+type FairQueueConfig struct {
+	Concurrency int            `json:"concurrency" yaml:"concurrency"`                 //Requests in flight to upstreams
+	MaxQueue    int            `json:"max_queue,omitempty" yaml:"max_queue,omitempty"` //Requests waiting, of all clients
+	Timeout     int            `json:"timeout,omitempty" yaml:"timeout,omitempty"`     //Seconds a request may wait
+	Weights     map[string]int `json:"weights,omitempty" yaml:"weights,omitempty"`     //Of the clients of a tier
+}
+
+func (c *FairQueueConfig) validate() error {
+	if c.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if c.MaxQueue == 0 {
+		c.MaxQueue = DEFAULT_MAX_QUEUE
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DEFAULT_QUEUE_TIMEOUT
+	}
+	if c.MaxQueue < 0 || c.Timeout < 0 {
+		return errors.New("max_queue and timeout must not be negative")
+	}
+	for tier, weight := range c.Weights {
+		if weight < 1 {
+			return fmt.Errorf("weight of tier %s must be at least 1", tier)
+		}
+	}
+	return nil
+}
+
+func (c *FairQueueConfig) weightOf(identity Identity) int {
+	if weight, ok := c.Weights[identity.Tier]; ok {
+		return weight
+	}
+	return 1
+}
+
+//FairQueue admits requests to upstreams
+type FairQueue struct {
+	concurrency int
+	inFlight    int
+	queued      int
+	active      []*clientQueue //Clients with queued requests, in round robin order
+	clients     map[string]*clientQueue
+	stats       map[string]*QueueStat
+	sync.Mutex
+}
+
+type clientQueue struct {
+	key     string
+	weight  int
+	deficit int
+	waiters []*waiter
+}
+
+type waiter struct {
+	ready    chan struct{}
+	admitted bool
+}
+
+//QueueStat is the waiting of a client reported in /stats/queue
+type QueueStat struct {
+	Client   string  `json:"client"`
+	Queued   int     `json:"queued"`
+	Admitted int64   `json:"admitted"` //After waiting in the queue
+	Rejected int64   `json:"rejected"` //Because the queue was full or the request timed out
+	AvgWait  float64 `json:"avg_wait_ms"`
+	MaxWait  float64 `json:"max_wait_ms"`
+
+	totalWait time.Duration
+	lastSeen  time.Time
+}
+
+//QueueStats are reported in /stats/queue
+type QueueStats struct {
+	InFlight int         `json:"in_flight"`
+	Queued   int         `json:"queued"`
+	Clients  []QueueStat `json:"clients"`
+}
+
+func NewFairQueue() *FairQueue {
+	return &FairQueue{clients: make(map[string]*clientQueue), stats: make(map[string]*QueueStat)}
+}
+
+//Admits a request of the client, waiting in the queue while concurrency requests
+//are in flight. Admitted requests must be released once done.
+func (q *FairQueue) Acquire(ctx context.Context, c *FairQueueConfig, identity Identity) error {
+	q.Lock()
+	q.concurrency = c.Concurrency
+	if q.inFlight < q.concurrency && q.queued == 0 {
+		q.inFlight++
+		q.Unlock()
+		return nil
+	}
+	stat := q.stat(identity.Key)
+	if q.queued >= c.MaxQueue {
+		stat.Rejected++
+		q.Unlock()
+		return errQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	cq, ok := q.clients[identity.Key]
+	if !ok {
+		cq = &clientQueue{key: identity.Key}
+		q.clients[identity.Key] = cq
+		q.active = append(q.active, cq)
+	}
+	cq.weight = c.weightOf(identity)
+	cq.waiters = append(cq.waiters, w)
+	q.queued++
+	stat.Queued++
+	q.Unlock()
+
+	start := time.Now()
+	timeout := time.NewTimer(time.Duration(c.Timeout) * time.Second)
+	defer timeout.Stop()
+	var err error
+	select {
+	case <-w.ready:
+	case <-timeout.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	stat = q.stat(identity.Key)
+	if err != nil && !w.admitted {
+		q.remove(cq, w)
+		stat.Queued--
+		stat.Rejected++
+		return err
+	}
+	wait := time.Since(start)
+	stat.Queued--
+	stat.Admitted++
+	stat.totalWait += wait
+	stat.AvgWait = float64(stat.totalWait/time.Duration(stat.Admitted)) / float64(time.Millisecond)
+	if ms := float64(wait) / float64(time.Millisecond); ms > stat.MaxWait {
+		stat.MaxWait = ms
+	}
+	return nil
+}
+
+//Releases an admitted request and admits the next queued ones
+func (q *FairQueue) Release() {
+	q.Lock()
+	defer q.Unlock()
+	q.inFlight--
+	for q.inFlight < q.concurrency {
+		w := q.next()
+		if w == nil {
+			return
+		}
+		w.admitted = true
+		close(w.ready)
+		q.inFlight++
+	}
+}
+
+//Returns the next waiter by deficit round robin, every request costs 1
+func (q *FairQueue) next() *waiter {
+	for len(q.active) > 0 {
+		cq := q.active[0]
+		if cq.deficit < 1 {
+			cq.deficit += cq.weight
+		}
+		w := cq.waiters[0]
+		cq.waiters = cq.waiters[1:]
+		cq.deficit--
+		q.queued--
+		switch {
+		case len(cq.waiters) == 0:
+			q.active = q.active[1:]
+			delete(q.clients, cq.key)
+		case cq.deficit < 1:
+			q.active = append(q.active[1:], cq)
+		}
+		return w
+	}
+	return nil
+}
+
+//Removes a waiter that gave up
+func (q *FairQueue) remove(cq *clientQueue, w *waiter) {
+	for i, queued := range cq.waiters {
+		if queued == w {
+			cq.waiters = append(cq.waiters[:i], cq.waiters[i+1:]...)
+			q.queued--
+			break
+		}
+	}
+	if len(cq.waiters) > 0 {
+		return
+	}
+	for i, active := range q.active {
+		if active == cq {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			break
+		}
+	}
+	delete(q.clients, cq.key)
+}
+
+//Returns the stats of the client, pruning idle clients when there are too many
+func (q *FairQueue) stat(key string) *QueueStat {
+	now := time.Now()
+	stat, ok := q.stats[key]
+	if !ok {
+		if len(q.stats) >= MAX_QUEUE_CLIENTS {
+			q.prune(now)
+		}
+		stat = &QueueStat{Client: key}
+		q.stats[key] = stat
+	}
+	stat.lastSeen = now
+	return stat
+}
+
+func (q *FairQueue) prune(now time.Time) {
+	for key, stat := range q.stats {
+		if stat.Queued == 0 && now.Sub(stat.lastSeen) > QUEUE_STATS_TTL {
+			delete(q.stats, key)
+		}
+	}
+}
+
+//Returns the queue depth and the waiting of every client, sorted by client
+func (q *FairQueue) Stats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+	q.prune(time.Now())
+	stats := QueueStats{InFlight: q.inFlight, Queued: q.queued, Clients: []QueueStat{}}
+	for _, stat := range q.stats {
+		stats.Clients = append(stats.Clients, *stat)
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool { return stats.Clients[i].Client < stats.Clients[j].Client })
+	return stats
+}
+
+func queueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(fairQueue.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fair queue", func() {
+	var (
+		cfg   *FairQueueConfig
+		queue *FairQueue
+		mu    sync.Mutex
+		order []string
+	)
+
+	BeforeEach(func() {
+		cfg = &FairQueueConfig{Concurrency: 1, MaxQueue: 10, Timeout: 5, Weights: map[string]int{"pro": 2}}
+		Expect(cfg.validate()).To(Succeed())
+		queue = NewFairQueue()
+		order = nil
+		Expect(queue.Acquire(context.Background(), cfg, Identity{Key: "first"})).To(Succeed())
+	})
+
+	enqueue := func(identity Identity) {
+		queued := queue.Stats().Queued
+		go func() {
+			defer GinkgoRecover()
+			Expect(queue.Acquire(context.Background(), cfg, identity)).To(Succeed())
+			mu.Lock()
+			order = append(order, identity.Key)
+			mu.Unlock()
+		}()
+		Eventually(func() int { return queue.Stats().Queued }).Should(Equal(queued + 1))
+	}
+
+	admitted := func(n int) []string {
+		for i := 0; i < n; i++ {
+			queue.Release()
+			Eventually(func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(order)
+			}).Should(Equal(i + 1))
+		}
+		return order
+	}
+
+	It("admits queued requests round robin across clients", func() {
+		for i := 0; i < 3; i++ {
+			enqueue(Identity{Key: "heavy"})
+		}
+		enqueue(Identity{Key: "light"})
+		Expect(admitted(4)).To(Equal([]string{"heavy", "light", "heavy", "heavy"}))
+	})
+
+	It("admits clients by the weight of their tier", func() {
+		for i := 0; i < 3; i++ {
+			enqueue(Identity{Key: "pro", Tier: "pro"})
+		}
+		for i := 0; i < 2; i++ {
+			enqueue(Identity{Key: "free"})
+		}
+		Expect(admitted(5)).To(Equal([]string{"pro", "pro", "free", "pro", "free"}))
+	})
+
+	It("reports the queue depth and the waiting time per client", func() {
+		enqueue(Identity{Key: "light"})
+		stats := queue.Stats()
+		Expect(stats.InFlight).To(Equal(1))
+		Expect(stats.Clients).To(HaveLen(1))
+		Expect(stats.Clients[0].Queued).To(Equal(1))
+
+		time.Sleep(10 * time.Millisecond)
+		admitted(1)
+		Eventually(func() int64 { return queue.Stats().Clients[0].Admitted }).Should(Equal(int64(1)))
+		Expect(queue.Stats().Clients[0].MaxWait).To(BeNumerically(">=", 10))
+	})
+
+	It("rejects requests when the queue is full or they waited too long", func() {
+		cfg.MaxQueue = 1
+		cfg.Timeout = 1
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error)
+		go func() { errs <- queue.Acquire(ctx, cfg, Identity{Key: "a"}) }()
+		Eventually(func() int { return queue.Stats().Queued }).Should(Equal(1))
+		Expect(queue.Acquire(context.Background(), cfg, Identity{Key: "b"})).To(Equal(errQueueFull))
+
+		cancel()
+		Expect(<-errs).To(Equal(context.Canceled))
+		Expect(queue.Stats().Queued).To(Equal(0))
+		Expect(queue.Acquire(context.Background(), cfg, Identity{Key: "c"})).To(Equal(errQueueTimeout))
+	})
+})
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	DISTRIBUTION_FIXED       = "fixed"
+	DISTRIBUTION_UNIFORM     = "uniform"
+	DISTRIBUTION_NORMAL      = "normal"
+	DISTRIBUTION_PERCENTILES = "percentiles"
+
+	PHASE_BEFORE = "before" //Delay before the request is sent upstream
+	PHASE_AFTER  = "after"  //Delay after the upstream responded
+
+	FAULT_DELAY_HEADER = "X-Fault-Delay" //Milliseconds to delay the request by
+	FAULT_ABORT_HEADER = "X-Fault-Abort" //Status to abort the request with
+
+	DEFAULT_MAX_HEADER_DELAY = 10000 //Milliseconds
+)
+
+var (
+	randFloat = rand.Float64
+	randNorm  = rand.NormFloat64
+)
+
+//FaultConfig injects latency and errors into proxied requests, for all
+//requests or per rule. A rule with faults replaces the default faults.
+//
+//	faults:
+//	  header_triggers: true
+//	  delay:
+//	    distribution: percentiles
+//	    percentiles: {50: 20, 90: 100, 99: 800}
+//	  abort:
+//	    status: 503
+//	    percentage: 1
+type FaultConfig struct {
+	Delay          *DelayFault `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Abort          *AbortFault `json:"abort,omitempty" yaml:"abort,omitempty"`
+	HeaderTriggers bool        `json:"header_triggers,omitempty" yaml:"header_triggers,omitempty"`   //Honour X-Fault-Delay and X-Fault-Abort
+	MaxHeaderDelay int         `json:"max_header_delay,omitempty" yaml:"max_header_delay,omitempty"` //Milliseconds X-Fault-Delay is capped at, 10000 by default
+}
+
+//DelayFault delays a percentage of requests by a latency in milliseconds drawn from a distribution
+type DelayFault struct {
+	Distribution string      `json:"distribution,omitempty" yaml:"distribution,omitempty"` //fixed (default), uniform, normal or percentiles
+	Phase        string      `json:"phase,omitempty" yaml:"phase,omitempty"`               //before (default) or after the upstream
+	Percentage   *float64    `json:"percentage,omitempty" yaml:"percentage,omitempty"`     //Of requests delayed, 100 when unset
+	Fixed        int         `json:"fixed,omitempty" yaml:"fixed,omitempty"`
+	Min          int         `json:"min,omitempty" yaml:"min,omitempty"`
+	Max          int         `json:"max,omitempty" yaml:"max,omitempty"`
+	Mean         int         `json:"mean,omitempty" yaml:"mean,omitempty"`
+	StdDev       int         `json:"stddev,omitempty" yaml:"stddev,omitempty"`
+	Percentiles  map[int]int `json:"percentiles,omitempty" yaml:"percentiles,omitempty"` //Latency at each percentile, interpolated in between
+}
+
+//AbortFault answers a percentage of requests with the status instead of forwarding them
+type AbortFault struct {
+	Status     int      `json:"status" yaml:"status"`
+	Percentage *float64 `json:"percentage,omitempty" yaml:"percentage,omitempty"` //Of requests aborted, 100 when unset
+}
+
+//Faults are the faults drawn for one request
+type Faults struct {
+	Before int //Milliseconds
+	After  int //Milliseconds
+	Abort  int //Status, 0 to forward the request
+}
+
+func (f *FaultConfig) validate() error {
+	if f.MaxHeaderDelay < 0 {
+		return errors.New("max_header_delay must not be negative")
+	}
+	if f.Delay != nil {
+		if err := f.Delay.validate(); err != nil {
+			return fmt.Errorf("delay: %s", err)
+		}
+	}
+	if f.Abort != nil {
+		if f.Abort.Status < 400 || f.Abort.Status > 599 {
+			return fmt.Errorf("abort: status must be a 4xx or 5xx, got %d", f.Abort.Status)
+		}
+		if err := validatePercentage(f.Abort.Percentage); err != nil {
+			return fmt.Errorf("abort: %s", err)
+		}
+	}
+	return nil
+}
+
+func (d *DelayFault) validate() error {
+	if d.Phase != "" && d.Phase != PHASE_BEFORE && d.Phase != PHASE_AFTER {
+		return fmt.Errorf("phase must be %q or %q", PHASE_BEFORE, PHASE_AFTER)
+	}
+	if err := validatePercentage(d.Percentage); err != nil {
+		return err
+	}
+	switch d.Distribution {
+	case "", DISTRIBUTION_FIXED:
+		if d.Fixed < 0 {
+			return errors.New("fixed must not be negative")
+		}
+	case DISTRIBUTION_UNIFORM:
+		if d.Min < 0 || d.Max < d.Min {
+			return errors.New("uniform requires 0 <= min <= max")
+		}
+	case DISTRIBUTION_NORMAL:
+		if d.Mean < 0 || d.StdDev < 0 {
+			return errors.New("mean and stddev must not be negative")
+		}
+	case DISTRIBUTION_PERCENTILES:
+		if len(d.Percentiles) == 0 {
+			return errors.New("percentiles are required")
+		}
+		previous := -1
+		for _, p := range sortedPercentiles(d.Percentiles) {
+			if p < 0 || p > 100 {
+				return fmt.Errorf("percentile %d must be between 0 and 100", p)
+			}
+			if d.Percentiles[p] < previous {
+				return errors.New("latencies must not decrease with the percentile")
+			}
+			previous = d.Percentiles[p]
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q", d.Distribution)
+	}
+	return nil
+}
+
+func validatePercentage(p *float64) error {
+	if p != nil && (*p < 0 || *p > 100) {
+		return fmt.Errorf("percentage must be between 0 and 100, got %g", *p)
+	}
+	return nil
+}
+
+func sortedPercentiles(percentiles map[int]int) []int {
+	keys := make([]int, 0, len(percentiles))
+	for p := range percentiles {
+		keys = append(keys, p)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+//Returns true for the percentage of calls, always when the percentage is unset
+func hit(percentage *float64) bool {
+	return percentage == nil || randFloat()*100 < *percentage
+}
+
+//Draws a latency in milliseconds from the distribution
+func (d *DelayFault) sample() int {
+	switch d.Distribution {
+	case DISTRIBUTION_UNIFORM:
+		return d.Min + int(randFloat()*float64(d.Max-d.Min+1))
+	case DISTRIBUTION_NORMAL:
+		return int(math.Max(0, math.Round(float64(d.Mean)+randNorm()*float64(d.StdDev))))
+	case DISTRIBUTION_PERCENTILES:
+		return interpolate(d.Percentiles, randFloat()*100)
+	}
+	return d.Fixed
+}
+
+//Returns the latency at percentile p, interpolated between the configured percentiles
+func interpolate(percentiles map[int]int, p float64) int {
+	keys := sortedPercentiles(percentiles)
+	if p <= float64(keys[0]) {
+		return percentiles[keys[0]]
+	}
+	for i := 1; i < len(keys); i++ {
+		lo, hi := keys[i-1], keys[i]
+		if p <= float64(hi) {
+			ratio := (p - float64(lo)) / float64(hi-lo)
+			return percentiles[lo] + int(ratio*float64(percentiles[hi]-percentiles[lo]))
+		}
+	}
+	return percentiles[keys[len(keys)-1]]
+}
+
+//Draws the faults for a request: those requested by headers when enabled, then
+//those of the matching rule, or the default faults of the scope of the request.
+func faultsFor(req *http.Request, rule *Rule, defaults *FaultConfig) Faults {
+	faults := Faults{}
+	abortHeader, delayHeader := req.Header.Get(FAULT_ABORT_HEADER), req.Header.Get(FAULT_DELAY_HEADER)
+	req.Header.Del(FAULT_ABORT_HEADER)
+	req.Header.Del(FAULT_DELAY_HEADER)
+
+	config := defaults
+	if rule != nil && rule.Faults != nil {
+		config = rule.Faults
+	}
+	if config == nil {
+		return faults
+	}
+
+	if config.HeaderTriggers {
+		if status, err := strconv.Atoi(abortHeader); err == nil && status >= 400 && status <= 599 {
+			faults.Abort = status
+		}
+		if delay, err := strconv.Atoi(delayHeader); err == nil && delay > 0 {
+			max := config.MaxHeaderDelay
+			if max == 0 {
+				max = DEFAULT_MAX_HEADER_DELAY
+			}
+			if delay > max {
+				delay = max
+			}
+			faults.Before += delay
+		}
+	}
+
+	if config.Abort != nil && faults.Abort == 0 && hit(config.Abort.Percentage) {
+		faults.Abort = config.Abort.Status
+	}
+	if config.Delay != nil && hit(config.Delay.Percentage) {
+		if config.Delay.Phase == PHASE_AFTER {
+			faults.After += config.Delay.sample()
+		} else {
+			faults.Before += config.Delay.sample()
+		}
+	}
+	return faults
+}
+
+//Returns a copy of the faults with the delay replaced by the legacy delay: a
+//fixed delay after the upstream responded, none when 0
+func (f *FaultConfig) withDelay(delay int) *FaultConfig {
+	faults := FaultConfig{}
+	if f != nil {
+		faults = *f
+	}
+	faults.Delay = nil
+	if delay > 0 {
+		faults.Delay = &DelayFault{Fixed: delay, Phase: PHASE_AFTER}
+	}
+	return &faults
+}
+
+//Returns a copy of the config with the default faults replaced
+func (c *Config) withFaults(faults *FaultConfig) *Config {
+	cfg := *c
+	cfg.Faults = faults
+	return &cfg
+}
+
+func abortResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("Injected fault")),
+	}
+}
+
+//Admin API for the default faults:
+//
+//	GET    /faults  returns the default faults
+//	PUT    /faults  replaces the default faults until the next config reload
+//	DELETE /faults  removes the default faults
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentRateLimiter().Config().Faults)
+	case "PUT":
+		faults := &FaultConfig{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(faults); err != nil {
+			http.Error(w, "invalid faults: "+err.Error(), 400)
+			return
+		}
+		if err := faults.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		updateConfig(func(c *Config) *Config { return c.withFaults(faults) })
+		log.Printf("Updated faults")
+		w.WriteHeader(204)
+	case "DELETE":
+		updateConfig(func(c *Config) *Config { return c.withFaults(nil) })
+		log.Printf("Removed faults")
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Faults", func() {
+	var (
+		cfg *Config
+		req *http.Request
+	)
+
+	BeforeEach(func() {
+		half := 50.0
+		cfg = &Config{
+			Version: CONFIG_VERSION,
+			Limit:   10,
+			Faults: &FaultConfig{
+				HeaderTriggers: true,
+				Delay:          &DelayFault{Fixed: 20},
+			},
+			Rules: []Rule{
+				{Name: "reports", Limit: 10, Faults: &FaultConfig{
+					Delay: &DelayFault{Distribution: DISTRIBUTION_UNIFORM, Min: 100, Max: 200, Phase: PHASE_AFTER},
+					Abort: &AbortFault{Status: 503, Percentage: &half},
+				}},
+			},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+		req, _ = http.NewRequest("GET", "http://example.com/", nil)
+		randFloat = func() float64 { return 0.25 }
+		randNorm = func() float64 { return -1 }
+	})
+
+	AfterEach(func() {
+		randFloat = rand.Float64
+		randNorm = rand.NormFloat64
+	})
+
+	It("applies the default faults, with the delay of the scope in place of the default delay", func() {
+		Expect(faultsFor(req, nil, cfg.Faults)).To(Equal(Faults{Before: 20}))
+		Expect(faultsFor(req, nil, cfg.Faults.withDelay(5))).To(Equal(Faults{After: 5}))
+		Expect(faultsFor(req, nil, cfg.Faults.withDelay(0))).To(Equal(Faults{}))
+	})
+
+	It("migrates the legacy delay into the default faults once", func() {
+		legacy := &Config{Version: CONFIG_VERSION, Limit: 10, Delay: 30}
+		Expect(legacy.Validate()).To(Succeed())
+		Expect(legacy.Delay).To(Equal(0))
+		Expect(legacy.Faults).To(Equal(&FaultConfig{Delay: &DelayFault{Fixed: 30, Phase: PHASE_AFTER}}))
+		Expect(legacy.Validate()).To(Succeed())
+		Expect(faultsFor(req, nil, legacy.Faults)).To(Equal(Faults{After: 30}))
+
+		cfg.Delay = 30
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("faults.delay")))
+	})
+
+	It("replaces the default faults with those of the rule", func() {
+		Expect(faultsFor(req, &cfg.Rules[0], cfg.Faults)).To(Equal(Faults{After: 125, Abort: 503}))
+		randFloat = func() float64 { return 0.75 }
+		Expect(faultsFor(req, &cfg.Rules[0], cfg.Faults)).To(Equal(Faults{After: 175}))
+	})
+
+	It("never injects faults with a percentage of 0", func() {
+		never := 0.0
+		cfg.Rules[0].Faults.Abort.Percentage = &never
+		cfg.Rules[0].Faults.Delay.Percentage = &never
+		randFloat = func() float64 { return 0 }
+		Expect(faultsFor(req, &cfg.Rules[0], cfg.Faults)).To(Equal(Faults{}))
+	})
+
+	It("injects faults requested by headers when enabled, and strips the headers", func() {
+		req.Header.Set(FAULT_DELAY_HEADER, "300")
+		req.Header.Set(FAULT_ABORT_HEADER, "502")
+		Expect(faultsFor(req, nil, cfg.Faults)).To(Equal(Faults{Before: 320, Abort: 502}))
+		Expect(req.Header.Get(FAULT_DELAY_HEADER)).To(BeEmpty())
+
+		req.Header.Set(FAULT_ABORT_HEADER, "502")
+		Expect(faultsFor(req, &cfg.Rules[0], cfg.Faults).Abort).To(Equal(503))
+		Expect(req.Header.Get(FAULT_ABORT_HEADER)).To(BeEmpty())
+	})
+
+	It("caps the delay requested by headers", func() {
+		req.Header.Set(FAULT_DELAY_HEADER, "3600000")
+		Expect(faultsFor(req, nil, cfg.Faults).Before).To(Equal(DEFAULT_MAX_HEADER_DELAY + 20))
+
+		cfg.Faults.MaxHeaderDelay = 500
+		req.Header.Set(FAULT_DELAY_HEADER, "3600000")
+		Expect(faultsFor(req, nil, cfg.Faults).Before).To(Equal(520))
+	})
+
+	It("stops delaying requests whose client went away", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		delayInMilliseconds(ctx, 60000)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("draws latencies from the distributions", func() {
+		Expect((&DelayFault{Distribution: DISTRIBUTION_NORMAL, Mean: 100, StdDev: 30}).sample()).To(Equal(70))
+		Expect((&DelayFault{Distribution: DISTRIBUTION_NORMAL, Mean: 10, StdDev: 30}).sample()).To(Equal(0))
+
+		percentiles := &DelayFault{Distribution: DISTRIBUTION_PERCENTILES, Percentiles: map[int]int{10: 10, 50: 50, 90: 450}}
+		Expect(percentiles.sample()).To(Equal(25))
+		Expect(interpolate(percentiles.Percentiles, 5)).To(Equal(10))
+		Expect(interpolate(percentiles.Percentiles, 70)).To(Equal(250))
+		Expect(interpolate(percentiles.Percentiles, 99)).To(Equal(450))
+	})
+
+	It("validates the faults", func() {
+		Expect((&FaultConfig{Abort: &AbortFault{Status: 200}}).validate()).To(HaveOccurred())
+		Expect((&FaultConfig{Delay: &DelayFault{Distribution: "pareto"}}).validate()).To(HaveOccurred())
+		Expect((&FaultConfig{Delay: &DelayFault{Distribution: DISTRIBUTION_UNIFORM, Min: 5, Max: 1}}).validate()).To(HaveOccurred())
+		Expect((&FaultConfig{Delay: &DelayFault{Distribution: DISTRIBUTION_PERCENTILES, Percentiles: map[int]int{50: 100, 90: 10}}}).validate()).To(HaveOccurred())
+		Expect((&FaultConfig{Delay: &DelayFault{Phase: "during"}}).validate()).To(HaveOccurred())
+	})
+
+	It("changes the default faults at runtime", func() {
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		w := httptest.NewRecorder()
+		faultsHandler(w, httptest.NewRequest("PUT", "/faults", bytes.NewBufferString(`{"abort": {"status": 503, "percentage": 10}}`)))
+		Expect(w.Code).To(Equal(204))
+		tenth := 10.0
+		Expect(currentRateLimiter().Config().Faults).To(Equal(&FaultConfig{Abort: &AbortFault{Status: 503, Percentage: &tenth}}))
+
+		w = httptest.NewRecorder()
+		faultsHandler(w, httptest.NewRequest("PUT", "/faults", bytes.NewBufferString(`{"abort": {"status": 200}}`)))
+		Expect(w.Code).To(Equal(400))
+
+		w = httptest.NewRecorder()
+		faultsHandler(w, httptest.NewRequest("DELETE", "/faults", nil))
+		Expect(w.Code).To(Equal(204))
+		Expect(currentRateLimiter().Config().Faults).To(BeNil())
+	})
+
+	It("does not let anonymous callers change the faults", func() {
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		w := httptest.NewRecorder()
+		adminOnly(faultsHandler)(w, httptest.NewRequest("PUT", "/faults", bytes.NewBufferString(`{"abort": {"status": 503}}`)))
+		Expect(w.Code).To(Equal(403))
+		Expect(currentRateLimiter().Config().Faults).To(Equal(cfg.Faults))
+	})
+})
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/vipinvkmenon/ratelimit-service/geoip"
+)
+
+var geoUsage = NewGeoStats()
+
+//GeoIPConfig looks client IPs up in local MaxMind databases so rules can match
+//on country and ASN. Country (or City) and ASN databases can be combined.
+//
+//	geoip:
+//	  databases:
+//	    - GeoLite2-Country.mmdb
+//	    - GeoLite2-ASN.mmdb
+type GeoIPConfig struct {
+	Databases []string `json:"databases" yaml:"databases"`
+
+	db *geoip.DB
+}
+
+//Validates the settings and opens the databases
+func (c *GeoIPConfig) validate() error {
+	if len(c.Databases) == 0 {
+		return errors.New("at least one database is required")
+	}
+	db, err := geoip.OpenDB(c.Databases...)
+	if err != nil {
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+//Looks up the client IP, returns an empty Info when GeoIP is not configured
+func (c *Config) lookupGeo(remoteIP string) geoip.Info {
+	if c.GeoIP == nil {
+		return geoip.Info{}
+	}
+	return c.GeoIP.db.Lookup(net.ParseIP(remoteIP))
+}
+
+func withGeo(req *http.Request, info geoip.Info) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), geoContextKey, info))
+}
+
+func geoFrom(req *http.Request) geoip.Info {
+	info, _ := req.Context().Value(geoContextKey).(geoip.Info)
+	return info
+}
+
+//GeoUsage counts the requests from one country or ASN
+type GeoUsage struct {
+	Requests int64 `json:"requests"`
+	Rejected int64 `json:"rejected"`
+}
+
+//GeoStats aggregates the consumption by country and ASN, reported in /stats/geo
+type GeoStats struct {
+	Countries map[string]*GeoUsage `json:"countries"`
+	ASNs      map[string]*GeoUsage `json:"asns"`
+	sync.Mutex
+}
+
+func NewGeoStats() *GeoStats {
+	return &GeoStats{
+		Countries: make(map[string]*GeoUsage),
+		ASNs:      make(map[string]*GeoUsage),
+	}
+}
+
+func (s *GeoStats) Record(info geoip.Info, rejected bool) {
+	if info == (geoip.Info{}) {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if info.Country != "" {
+		count(s.Countries, info.Country, rejected)
+	}
+	if info.ASN != 0 {
+		count(s.ASNs, strconv.FormatUint(uint64(info.ASN), 10), rejected)
+	}
+}
+
+func count(usage map[string]*GeoUsage, key string, rejected bool) {
+	u, ok := usage[key]
+	if !ok {
+		u = &GeoUsage{}
+		usage[key] = u
+	}
+	u.Requests++
+	if rejected {
+		u.Rejected++
+	}
+}
+
+func geoStatsHandler(w http.ResponseWriter, r *http.Request) {
+	geoUsage.Lock()
+	stats, err := json.Marshal(geoUsage)
+	geoUsage.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
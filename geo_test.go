@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/vipinvkmenon/ratelimit-service/geoip"
+	"github.com/vipinvkmenon/ratelimit-service/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Geo", func() {
+	var (
+		limiter *RateLimiter
+		req     *http.Request
+		id      Identity
+	)
+
+	BeforeEach(func() {
+		limiter = NewRateLimiterFromConfig(&Config{
+			Version: CONFIG_VERSION,
+			Limit:   5,
+			Rules: []Rule{
+				{Name: "office", Action: ACTION_EXEMPT, Match: Match{ASNs: []uint{64512}}},
+				{Name: "abusive", Action: ACTION_BLOCK, Match: Match{ASNs: []uint{64513}}},
+				{Name: "high-risk", Limit: 1, Match: Match{Countries: []string{"xx"}}},
+			},
+		}, nil)
+		req, _ = http.NewRequest("GET", "http://example.com/", nil)
+		id = Identity{Key: "10.0.0.1"}
+	})
+
+	It("exempts matching requests", func() {
+		req = withGeo(req, geoip.Info{Country: "XX", ASN: 64512})
+		for i := 0; i < 10; i++ {
+			Expect(limiter.Decide(req, id)).To(Equal(Decision{Rule: &limiter.Config().Rules[0], Result: store.Result{Allowed: true}}))
+		}
+	})
+
+	It("blocks matching requests", func() {
+		decision := limiter.Decide(withGeo(req, geoip.Info{ASN: 64513}), id)
+		Expect(decision.Blocked).To(BeTrue())
+		Expect(decision.Allowed).To(BeFalse())
+		Expect(decision.Rule.Name).To(Equal("abusive"))
+	})
+
+	It("applies the limit of rules matching the country", func() {
+		highRisk := withGeo(req, geoip.Info{Country: "XX"})
+		Expect(limiter.ExceedsLimitFor(highRisk, id)).To(BeFalse())
+		Expect(limiter.ExceedsLimitFor(highRisk, id)).To(BeTrue())
+		Expect(limiter.ExceedsLimitFor(req, id)).To(BeFalse())
+	})
+
+	It("requires geoip for rules matching on countries or asns", func() {
+		cfg := limiter.Config()
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("geoip is not configured")))
+		cfg.GeoIP = &GeoIPConfig{}
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("at least one database")))
+	})
+
+	It("rejects unknown actions", func() {
+		_, err := ParseConfig([]byte("version: 1\nlimit: 3\nrules:\n  - name: a\n    action: drop\n"))
+		Expect(err).To(MatchError(ContainSubstring("unknown action")))
+	})
+
+	It("aggregates usage by country and asn", func() {
+		stats := NewGeoStats()
+		stats.Record(geoip.Info{Country: "XX", ASN: 64512}, false)
+		stats.Record(geoip.Info{Country: "XX"}, true)
+		stats.Record(geoip.Info{}, true)
+		Expect(stats.Countries).To(Equal(map[string]*GeoUsage{"XX": {Requests: 2, Rejected: 1}}))
+		Expect(stats.ASNs).To(Equal(map[string]*GeoUsage{"64512": {Requests: 1}}))
+	})
+})
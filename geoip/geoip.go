@@ -0,0 +1,64 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+)
+
+//Info is what the databases know about an IP address
+type Info struct {
+	Country      string `json:"country,omitempty"`
+	ASN          uint   `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+//DB combines country (GeoIP2/GeoLite2 Country or City) and ASN databases
+type DB struct {
+	readers []*Reader
+}
+
+func OpenDB(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		r, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+func NewDB(readers ...*Reader) *DB {
+	return &DB{readers: readers}
+}
+
+//Looks the IP up in every database, fields unknown to all databases are left empty
+func (db *DB) Lookup(ip net.IP) Info {
+	info := Info{}
+	if db == nil || ip == nil {
+		return info
+	}
+	for _, r := range db.readers {
+		record, err := r.Lookup(ip)
+		if err != nil {
+			continue
+		}
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if country, ok := m["country"].(map[string]interface{}); ok && info.Country == "" {
+			if code, ok := country["iso_code"].(string); ok {
+				info.Country = strings.ToUpper(code)
+			}
+		}
+		if asn, ok := m["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint(asn)
+		}
+		if org, ok := m["autonomous_system_organization"].(string); ok && info.Organization == "" {
+			info.Organization = org
+		}
+	}
+	return info
+}
@@ -0,0 +1,13 @@
+package geoip_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestGeoip(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Geoip Suite")
+}
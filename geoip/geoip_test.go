@@ -0,0 +1,231 @@
+package geoip_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	. "github.com/vipinvkmenon/ratelimit-service/geoip"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//Encodes values in the MaxMind DB data section format
+func encode(buf *bytes.Buffer, v interface{}) {
+	control := func(typeNum int, size int) {
+		switch {
+		case size < 29:
+			buf.WriteByte(byte(typeNum<<5 | size))
+		case size < 285:
+			buf.WriteByte(byte(typeNum<<5 | 29))
+			buf.WriteByte(byte(size - 29))
+		default:
+			panic("size not supported by the test writer")
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		control(2, len(value))
+		buf.WriteString(value)
+	case uint32:
+		b := []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		control(6, len(b))
+		buf.Write(b)
+	case map[string]interface{}:
+		control(7, len(value))
+		keys := []string{}
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, value[k])
+		}
+	default:
+		panic(fmt.Sprintf("type %T not supported by the test writer", v))
+	}
+}
+
+type node struct {
+	children [2]*node
+	data     map[string]interface{}
+}
+
+//Builds an IPv6 database with 24 bit records for the networks
+func buildDB(networks map[string]map[string]interface{}) []byte {
+	root := &node{}
+	for cidr, data := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		Expect(err).ToNot(HaveOccurred())
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To16()
+		if bits == 32 {
+			//IPv4 networks live in ::/96, not in the IPv4-mapped ::ffff:0:0/96
+			ip = append(make(net.IP, 12), network.IP.To4()...)
+			ones += 96
+		}
+		n := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &node{}
+			}
+			n = n.children[bit]
+		}
+		n.data = data
+	}
+
+	var nodes []*node
+	var index func(n *node)
+	index = func(n *node) {
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.data == nil {
+				index(c)
+			}
+		}
+	}
+	index(root)
+	ids := make(map[*node]int)
+	for i, n := range nodes {
+		ids[n] = i
+	}
+
+	data := &bytes.Buffer{}
+	offsets := make(map[*node]int)
+	for _, n := range nodes {
+		for _, c := range n.children {
+			if c != nil && c.data != nil {
+				offsets[c] = data.Len()
+				encode(data, c.data)
+			}
+		}
+	}
+
+	tree := &bytes.Buffer{}
+	for _, n := range nodes {
+		for _, c := range n.children {
+			record := len(nodes)
+			if c != nil && c.data != nil {
+				record = len(nodes) + 16 + offsets[c]
+			} else if c != nil {
+				record = ids[c]
+			}
+			tree.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+
+	db := &bytes.Buffer{}
+	db.Write(tree.Bytes())
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encode(db, map[string]interface{}{
+		"database_type": "Test-Country-ASN",
+		"ip_version":    uint32(6),
+		"record_size":   uint32(24),
+		"node_count":    uint32(len(nodes)),
+	})
+	return db.Bytes()
+}
+
+var _ = Describe("GeoIP", func() {
+	var db []byte
+
+	BeforeEach(func() {
+		db = buildDB(map[string]map[string]interface{}{
+			"81.2.69.0/24": {
+				"country":                        map[string]interface{}{"iso_code": "gb"},
+				"autonomous_system_number":       uint32(20712),
+				"autonomous_system_organization": "Andrews & Arnold Ltd",
+			},
+			"2001:db8::/32": {
+				"country": map[string]interface{}{"iso_code": "DE"},
+			},
+		})
+	})
+
+	Describe("Reader", func() {
+		It("reads the metadata", func() {
+			r, err := FromBytes(db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Metadata.DatabaseType).To(Equal("Test-Country-ASN"))
+			Expect(r.Metadata.IPVersion).To(Equal(uint(6)))
+			Expect(r.Metadata.RecordSize).To(Equal(uint(24)))
+		})
+
+		It("looks up IPv4 and IPv6 addresses", func() {
+			r, err := FromBytes(db)
+			Expect(err).ToNot(HaveOccurred())
+
+			record, err := r.Lookup(net.ParseIP("81.2.69.160"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record).To(HaveKeyWithValue("autonomous_system_number", uint64(20712)))
+
+			record, err = r.Lookup(net.ParseIP("2001:db8::1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record).To(HaveKey("country"))
+
+			record, err = r.Lookup(net.ParseIP("10.0.0.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record).To(BeNil())
+		})
+
+		It("rejects files without metadata", func() {
+			_, err := FromBytes([]byte("not a database"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects pointer cycles in malformed files", func() {
+			_, err := FromBytes([]byte("\xAB\xCD\xEFMaxMind.com\x20\x00")) //A pointer to itself
+			Expect(err).To(MatchError(ContainSubstring("corrupt")))
+
+			_, err = FromBytes([]byte("\xAB\xCD\xEFMaxMind.com\xE1\x41a\x20\x00")) //A map holding a pointer to the map
+			Expect(err).To(MatchError(ContainSubstring("nested too deeply")))
+		})
+
+		It("rejects data nested too deeply", func() {
+			var nested interface{} = "leaf"
+			for i := 0; i < 600; i++ {
+				nested = map[string]interface{}{"a": nested}
+			}
+			meta := bytes.NewBufferString("\xAB\xCD\xEFMaxMind.com")
+			encode(meta, nested)
+			_, err := FromBytes(meta.Bytes())
+			Expect(err).To(MatchError(ContainSubstring("nested too deeply")))
+		})
+
+		It("rejects sizes beyond the file", func() {
+			_, err := FromBytes([]byte("\xAB\xCD\xEFMaxMind.com\xFF\xFF\xFF\xFF")) //A map of 16 million entries
+			Expect(err).To(HaveOccurred())
+
+			meta := bytes.NewBufferString("\xAB\xCD\xEFMaxMind.com")
+			encode(meta, map[string]interface{}{"ip_version": uint32(6), "record_size": uint32(32), "node_count": uint32(1 << 31)})
+			_, err = FromBytes(meta.Bytes())
+			Expect(err).To(MatchError(ContainSubstring("larger than the file")))
+		})
+	})
+
+	Describe("DB", func() {
+		It("extracts the country and ASN", func() {
+			r, err := FromBytes(db)
+			Expect(err).ToNot(HaveOccurred())
+			geo := NewDB(r)
+
+			Expect(geo.Lookup(net.ParseIP("81.2.69.1"))).To(Equal(Info{Country: "GB", ASN: 20712, Organization: "Andrews & Arnold Ltd"}))
+			Expect(geo.Lookup(net.ParseIP("2001:db8::2"))).To(Equal(Info{Country: "DE"}))
+			Expect(geo.Lookup(net.ParseIP("192.168.1.1"))).To(Equal(Info{}))
+		})
+
+		It("looks up nothing without databases", func() {
+			var geo *DB
+			Expect(geo.Lookup(net.ParseIP("81.2.69.1"))).To(Equal(Info{}))
+		})
+	})
+})
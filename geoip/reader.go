@@ -0,0 +1,358 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+var metadataStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	dataSectionSeparator = 16
+	maxDepth             = 512 //Nested maps, arrays and pointers, deeper data is corrupt or hostile
+)
+
+//Metadata describes the layout of a MaxMind DB file
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint
+	RecordSize   uint
+	NodeCount    uint
+	BuildEpoch   uint
+}
+
+//Reader looks up IP addresses in a MaxMind DB (.mmdb) file held in memory
+type Reader struct {
+	Metadata  Metadata
+	buffer    []byte
+	dataStart uint
+	ipv4Start uint
+}
+
+func Open(path string) (*Reader, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+func FromBytes(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataStart)
+	if i == -1 {
+		return nil, errors.New("not a MaxMind DB file, metadata not found")
+	}
+	metaStart := uint(i + len(metadataStart))
+	d := decoder{buffer: b[metaStart:]}
+	raw, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+
+	r := &Reader{buffer: b}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.IPVersion = toUint(meta["ip_version"])
+	r.Metadata.RecordSize = toUint(meta["record_size"])
+	r.Metadata.NodeCount = toUint(meta["node_count"])
+	r.Metadata.BuildEpoch = toUint(meta["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", r.Metadata.IPVersion)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	r.dataStart = treeSize + dataSectionSeparator
+	if r.Metadata.NodeCount > uint(len(b)) || r.dataStart > metaStart { //Node counts beyond the file would overflow the size
+		return nil, errors.New("search tree is larger than the file")
+	}
+
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func toUint(v interface{}) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	case uint32:
+		return uint(n)
+	case uint16:
+		return uint(n)
+	}
+	return 0
+}
+
+//Returns the record for the ip, or nil when the ip is not in the database
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, errors.New("cannot look up an IPv6 address in an IPv4-only database")
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < bits && node < nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.record(node, bit)
+	}
+	if node == nodeCount {
+		return nil, nil
+	}
+	if node < nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+
+	offset := node - nodeCount - dataSectionSeparator
+	d := decoder{buffer: r.buffer[r.dataStart:]}
+	value, _, err := d.decode(offset, 0)
+	return value, err
+}
+
+//Reads the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node uint, bit uint) uint {
+	b := r.buffer
+	switch r.Metadata.RecordSize {
+	case 24:
+		o := node*6 + bit*3
+		return uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+	case 28:
+		o := node * 7
+		if bit == 0 {
+			return uint(b[o+3]&0xF0)<<20 | uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+		}
+		return uint(b[o+3]&0x0F)<<24 | uint(b[o+4])<<16 | uint(b[o+5])<<8 | uint(b[o+6])
+	default:
+		o := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[o:]))
+	}
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errCorrupt = errors.New("corrupt data section")
+
+//Decodes the data section format shared by the data section and the metadata
+type decoder struct {
+	buffer []byte
+}
+
+//Decodes the value at the offset, depth counts the maps, arrays and pointers it is nested in
+func (d *decoder) decode(offset uint, depth uint) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data section nested too deeply")
+	}
+	typeNum, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typeNum == typePointer {
+		pointer, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if target, _, _, err := d.control(pointer); err != nil || target == typePointer {
+			return nil, 0, errCorrupt //Pointers must not point to pointers
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	return d.value(typeNum, size, offset, depth)
+}
+
+//Reads a control byte and returns the type, the payload size and the payload offset
+func (d *decoder) control(offset uint) (uint, uint, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errCorrupt
+	}
+	ctrl := d.buffer[offset]
+	offset++
+
+	typeNum := uint(ctrl >> 5)
+	if typeNum == typeExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errCorrupt
+		}
+		typeNum = 7 + uint(d.buffer[offset])
+		offset++
+	}
+	if typeNum == typePointer {
+		return typeNum, uint(ctrl & 0x1F), offset, nil
+	}
+
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buffer)) {
+			return 0, 0, 0, errCorrupt
+		}
+		extra := uintFrom(d.buffer[offset : offset+n])
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return typeNum, size, offset, nil
+}
+
+//Pointers address the start of the data section
+func (d *decoder) pointer(size uint, offset uint) (uint, uint, error) {
+	n := (size>>3)&0x3 + 1
+	if offset+n > uint(len(d.buffer)) {
+		return 0, 0, errCorrupt
+	}
+	b := d.buffer[offset : offset+n]
+	var pointer uint
+	switch n {
+	case 1:
+		pointer = (size&0x7)<<8 | uint(b[0])
+	case 2:
+		pointer = ((size&0x7)<<16 | uintFrom(b)) + 2048
+	case 3:
+		pointer = ((size&0x7)<<24 | uintFrom(b)) + 526336
+	default:
+		pointer = uintFrom(b)
+	}
+	return pointer, offset + n, nil
+}
+
+func (d *decoder) value(typeNum uint, size uint, offset uint, depth uint) (interface{}, uint, error) {
+	switch typeNum {
+	case typeMap:
+		m := make(map[string]interface{}, d.capacity(size, offset))
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, d.capacity(size, offset))
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errCorrupt
+	}
+	b := d.buffer[offset : offset+size]
+	next := offset + size
+	switch typeNum {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errCorrupt
+		}
+		return uint64(uintFrom(b)), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupt
+		}
+		return int32(uint32(uintFrom(b))), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typeNum)
+}
+
+//Bounds the capacity allocated for a map or array by the bytes left, every entry
+//takes at least one, so a corrupt size cannot allocate more than the file holds
+func (d *decoder) capacity(size uint, offset uint) uint {
+	if offset > uint(len(d.buffer)) {
+		return 0
+	}
+	if left := uint(len(d.buffer)) - offset; size > left {
+		return left
+	}
+	return size
+}
+
+func uintFrom(b []byte) uint {
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v
+}
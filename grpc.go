@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	GRPC_UNKNOWN            = 2
+	GRPC_DEADLINE_EXCEEDED  = 4
+	GRPC_PERMISSION_DENIED  = 7
+	GRPC_RESOURCE_EXHAUSTED = 8
+	GRPC_UNIMPLEMENTED      = 12
+	GRPC_INTERNAL           = 13
+	GRPC_UNAVAILABLE        = 14
+	GRPC_UNAUTHENTICATED    = 16
+)
+
+//Returns whether the request is a gRPC call, gRPC clients cannot interpret plain HTTP errors
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+//Returns the service and method of a gRPC call from its /package.Service/Method path
+func grpcMethod(req *http.Request) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if !isGRPC(req) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+//Returns whether the gRPC call matches one of the package.Service/Method or package.Service patterns
+func matchesGRPC(patterns []string, req *http.Request) bool {
+	service, method, ok := grpcMethod(req)
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == service || pattern == service+"/"+method {
+			return true
+		}
+	}
+	return false
+}
+
+func validateGRPCMethod(pattern string) error {
+	parts := strings.Split(pattern, "/")
+	if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return fmt.Errorf("grpc_methods must be package.Service or package.Service/Method, got %q", pattern)
+	}
+	return nil
+}
+
+//Returns the gRPC status code for the HTTP status of a rejection or upstream failure
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusUnauthorized:
+		return GRPC_UNAUTHENTICATED
+	case http.StatusForbidden:
+		return GRPC_PERMISSION_DENIED
+	case http.StatusNotFound:
+		return GRPC_UNIMPLEMENTED
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		return GRPC_RESOURCE_EXHAUSTED
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return GRPC_UNAVAILABLE
+	case http.StatusGatewayTimeout:
+		return GRPC_DEADLINE_EXCEEDED
+	case http.StatusBadRequest, http.StatusInternalServerError:
+		return GRPC_INTERNAL
+	}
+	return GRPC_UNKNOWN
+}
+
+//Builds the trailers-only gRPC response for the HTTP status: gRPC errors are
+//sent with HTTP status 200, the status and message in grpc-status and grpc-message.
+//Clients honouring pushback wait retryAfter before retrying.
+func grpcResponse(status int, message string, retryAfter time.Duration) *http.Response {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	setGRPCStatus(resp.Header, status, message, retryAfter)
+	return resp
+}
+
+func setGRPCStatus(header http.Header, status int, message string, retryAfter time.Duration) {
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(grpcCode(status)))
+	header.Set("Grpc-Message", encodeGRPCMessage(message))
+	if retryAfter > 0 {
+		header.Set("Grpc-Retry-Pushback-Ms", strconv.FormatInt(int64(retryAfter/time.Millisecond), 10))
+	}
+}
+
+//Percent-encodes the message as grpc-message requires
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
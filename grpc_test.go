@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("gRPC", func() {
+	call := func(path string) *http.Request {
+		req := httptest.NewRequest("POST", "http://ratelimiter.example.com"+path, strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		return req
+	}
+
+	It("parses the service and method of gRPC calls", func() {
+		service, method, ok := grpcMethod(call("/billing.v1.Invoices/Create"))
+		Expect(ok).To(BeTrue())
+		Expect(service).To(Equal("billing.v1.Invoices"))
+		Expect(method).To(Equal("Create"))
+
+		_, _, ok = grpcMethod(httptest.NewRequest("POST", "http://ratelimiter.example.com/billing.v1.Invoices/Create", nil))
+		Expect(ok).To(BeFalse()) //Not gRPC
+		_, _, ok = grpcMethod(call("/billing/v1/invoices"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("matches rules per service and method", func() {
+		cfg := &Config{Version: CONFIG_VERSION, Limit: 10, Rules: []Rule{
+			{Name: "create", Limit: 1, Match: Match{GRPCMethods: []string{"billing.v1.Invoices/Create"}}},
+			{Name: "invoices", Limit: 5, Match: Match{GRPCMethods: []string{"billing.v1.Invoices"}}},
+		}}
+		Expect(cfg.Validate()).To(Succeed())
+		Expect(cfg.MatchRule(call("/billing.v1.Invoices/Create")).Name).To(Equal("create"))
+		Expect(cfg.MatchRule(call("/billing.v1.Invoices/List")).Name).To(Equal("invoices"))
+		Expect(cfg.MatchRule(call("/billing.v1.Payments/List"))).To(BeNil())
+
+		cfg.Rules[0].Match.GRPCMethods = []string{"billing.v1.Invoices/Create/"}
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("grpc_methods")))
+	})
+
+	It("rejects gRPC calls with a gRPC status instead of an HTTP error", func() {
+		resp := (&Config{}).reject(call("/billing.v1.Invoices/Create"), 429, Decision{Result: store.Result{Limit: 2, RetryAfter: 1500 * time.Millisecond}})
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/grpc"))
+		Expect(resp.Header.Get("Grpc-Status")).To(Equal("8"))
+		Expect(resp.Header.Get("Grpc-Message")).To(Equal("Rate limit of 2 requests per second exceeded"))
+		Expect(resp.Header.Get("Grpc-Retry-Pushback-Ms")).To(Equal("1500"))
+
+		Expect(grpcResponse(503, "Service unavailable", 0).Header.Get("Grpc-Status")).To(Equal("14"))
+		Expect(encodeGRPCMessage("100% café")).To(Equal("100%25 caf%C3%A9"))
+	})
+
+	It("proxies gRPC calls over cleartext HTTP/2 and limits them per method", func() {
+		h2c := new(http.Protocols)
+		h2c.SetUnencryptedHTTP2(true)
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.ProtoMajor).To(Equal(2))
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write([]byte{0, 0, 0, 0, 0})
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		}))
+		backend.Config.Protocols = h2c
+		backend.Start()
+		defer backend.Close()
+
+		cfg := &Config{
+			Version: CONFIG_VERSION,
+			Limit:   100,
+			Server:  &ServerConfig{H2C: true},
+			Rules:   []Rule{{Name: "create", Limit: 1, Match: Match{GRPCMethods: []string{"billing.v1.Invoices/Create"}}}},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		server := cfg.newServer(l.Addr().String(), newProxy())
+		go server.Serve(l)
+		defer server.Close()
+
+		client := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+		invoke := func() *http.Response {
+			req, _ := http.NewRequest("POST", "http://"+l.Addr().String()+"/billing.v1.Invoices/Create", strings.NewReader("\x00\x00\x00\x00\x00"))
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set(CF_FORWARDED_URL, backend.URL+"/billing.v1.Invoices/Create")
+			resp, err := client.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp
+		}
+
+		resp := invoke()
+		Expect(resp.ProtoMajor).To(Equal(2))
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(resp.Trailer.Get("Grpc-Status")).To(Equal("0"))
+
+		resp = invoke()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(resp.Header.Get("Grpc-Status")).To(Equal("8"))
+	})
+})
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HEADERS_DRAFT  = "draft"  //RateLimit-* headers of the IETF draft
+	HEADERS_LEGACY = "legacy" //X-RateLimit-* headers
+	HEADERS_BOTH   = "both"
+	HEADERS_NONE   = "none"
+)
+
+//Adds the rate limit headers of the decision in the configured style, and
+//Retry-After when the request was rejected by a limit
+func (c *Config) setRateLimitHeaders(h http.Header, d Decision, now time.Time) {
+	if d.Limit == 0 {
+		return
+	}
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+
+	style := c.Headers
+	if style == "" {
+		style = HEADERS_BOTH
+	}
+	if style == HEADERS_DRAFT || style == HEADERS_BOTH {
+		h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+	}
+	if style == HEADERS_LEGACY || style == HEADERS_BOTH {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+int64(seconds(d.Reset)), 10))
+	}
+}
+
+//Rounds up to whole seconds, headers never advertise a zero wait for a pending refill
+func seconds(d time.Duration) int {
+	s := int(d / time.Second)
+	if d%time.Second != 0 {
+		s++
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limit headers", func() {
+	var (
+		cfg     *Config
+		header  http.Header
+		now     time.Time
+		allowed Decision
+	)
+
+	BeforeEach(func() {
+		cfg = &Config{Version: CONFIG_VERSION, Limit: 10}
+		header = http.Header{}
+		now = time.Unix(1000, 0)
+		allowed = Decision{Result: store.Result{Allowed: true, Limit: 10, Remaining: 7, Reset: 300 * time.Millisecond}}
+	})
+
+	It("adds draft and legacy headers by default", func() {
+		cfg.setRateLimitHeaders(header, allowed, now)
+		Expect(header.Get("RateLimit-Limit")).To(Equal("10"))
+		Expect(header.Get("RateLimit-Remaining")).To(Equal("7"))
+		Expect(header.Get("RateLimit-Reset")).To(Equal("1"))
+		Expect(header.Get("X-RateLimit-Limit")).To(Equal("10"))
+		Expect(header.Get("X-RateLimit-Remaining")).To(Equal("7"))
+		Expect(header.Get("X-RateLimit-Reset")).To(Equal("1001"))
+		Expect(header.Get("Retry-After")).To(BeEmpty())
+	})
+
+	It("adds the headers of the configured style only", func() {
+		cfg.Headers = HEADERS_DRAFT
+		cfg.setRateLimitHeaders(header, allowed, now)
+		Expect(header.Get("RateLimit-Limit")).To(Equal("10"))
+		Expect(header.Get("X-RateLimit-Limit")).To(BeEmpty())
+
+		header = http.Header{}
+		cfg.Headers = HEADERS_NONE
+		cfg.setRateLimitHeaders(header, allowed, now)
+		Expect(header).To(BeEmpty())
+	})
+
+	It("adds Retry-After to rejections", func() {
+		cfg.Headers = HEADERS_NONE
+		rejected := Decision{Result: store.Result{Limit: 10, Reset: time.Second, RetryAfter: 100 * time.Millisecond}}
+		cfg.setRateLimitHeaders(header, rejected, now)
+		Expect(header).To(Equal(http.Header{"Retry-After": {"1"}}))
+	})
+
+	It("adds no headers when no limit applied", func() {
+		cfg.setRateLimitHeaders(header, Decision{Result: store.Result{Allowed: true}}, now)
+		Expect(header).To(BeEmpty())
+	})
+
+	It("reports the bucket that decided the request", func() {
+		limiter := NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 2}, nil)
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		id := Identity{Key: "10.0.0.1"}
+		Expect(limiter.Decide(req, id).Remaining).To(Equal(1))
+		Expect(limiter.Decide(req, id).Remaining).To(Equal(0))
+		decision := limiter.Decide(req, id)
+		Expect(decision.Allowed).To(BeFalse())
+		Expect(decision.RetryAfter).To(Equal(500 * time.Millisecond))
+	})
+
+	It("rejects unknown styles", func() {
+		cfg.Headers = "custom"
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("headers must be one of")))
+	})
+})
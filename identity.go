@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/vipinvkmenon/ratelimit-service/jwt"
+)
+
+const (
+	INVALID_TOKEN_FALLBACK = "fallback" //Limit requests with invalid tokens by client IP
+	INVALID_TOKEN_REJECT   = "reject"   //Reject requests with invalid tokens with 401
+
+	DEFAULT_SUBJECT_CLAIM = "sub"
+	DEFAULT_TIER_CLAIM    = "plan"
+)
+
+var errInvalidToken = errors.New("invalid bearer token")
+
+//Identity is the client a request is limited as
+type Identity struct {
+	Key   string //Bucket key, the client IP or the verified subject
+	Tier  string //Plan tier selecting the limit from the configured tiers
+	Limit int    //Custom limit overriding the tier, 0 when unset
+	KeyID string //Id of the API key the client was identified by
+}
+
+//JWTConfig verifies bearer tokens and limits requests by their subject and plan tier.
+//
+//	tiers:
+//	  free: 5
+//	  pro: 50
+//	jwt:
+//	  secret_env: JWT_SECRET
+//	  jwks_file: /home/vcap/app/jwks.json
+//	  tier_claim: plan
+//	  invalid_token: reject
+type JWTConfig struct {
+	Secret       string `json:"secret,omitempty" yaml:"secret,omitempty"`         //HS256 shared secret
+	SecretEnv    string `json:"secret_env,omitempty" yaml:"secret_env,omitempty"` //Env var holding the HS256 shared secret
+	JWKSFile     string `json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`   //Public keys for RS256/ES256
+	Issuer       string `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience     string `json:"audience,omitempty" yaml:"audience,omitempty"`
+	SubjectClaim string `json:"subject_claim,omitempty" yaml:"subject_claim,omitempty"`
+	TierClaim    string `json:"tier_claim,omitempty" yaml:"tier_claim,omitempty"`
+	DefaultTier  string `json:"default_tier,omitempty" yaml:"default_tier,omitempty"`
+	InvalidToken string `json:"invalid_token,omitempty" yaml:"invalid_token,omitempty"`
+
+	verifier *jwt.Verifier
+}
+
+//Validates the settings and loads the keys tokens are verified with
+func (c *JWTConfig) validate(tiers map[string]int) error {
+	if c.InvalidToken == "" {
+		c.InvalidToken = INVALID_TOKEN_FALLBACK
+	}
+	if c.InvalidToken != INVALID_TOKEN_FALLBACK && c.InvalidToken != INVALID_TOKEN_REJECT {
+		return fmt.Errorf("invalid_token must be %q or %q", INVALID_TOKEN_FALLBACK, INVALID_TOKEN_REJECT)
+	}
+	if c.SubjectClaim == "" {
+		c.SubjectClaim = DEFAULT_SUBJECT_CLAIM
+	}
+	if c.TierClaim == "" {
+		c.TierClaim = DEFAULT_TIER_CLAIM
+	}
+	if _, ok := tiers[c.DefaultTier]; c.DefaultTier != "" && !ok {
+		return fmt.Errorf("default_tier %q is not a configured tier", c.DefaultTier)
+	}
+
+	secret := c.Secret
+	if c.SecretEnv != "" {
+		secret = os.Getenv(c.SecretEnv)
+	}
+	if secret == "" && c.JWKSFile == "" {
+		return errors.New("a secret or a jwks_file is required")
+	}
+
+	c.verifier = jwt.NewVerifier([]byte(secret))
+	if c.JWKSFile != "" {
+		data, err := ioutil.ReadFile(c.JWKSFile)
+		if err != nil {
+			return err
+		}
+		if err := c.verifier.AddJWKS(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Identifies the client of a request by its API key or bearer token, falling back to its
+//client certificate when configured, or to the client IP
+func (c *Config) identify(req *http.Request, remoteIP string) (Identity, error) {
+	anonymous := Identity{Key: remoteIP}
+	if key := c.TLS.clientKey(req); key != "" {
+		anonymous = Identity{Key: key}
+	}
+	if c.APIKeys != nil {
+		if key := c.APIKeys.keyFrom(req); key != "" {
+			return c.APIKeys.identify(key, remoteIP)
+		}
+	}
+	if c.JWT == nil {
+		return anonymous, nil
+	}
+	token := bearerToken(req)
+	if token == "" {
+		return anonymous, nil
+	}
+
+	claims, err := c.JWT.verify(token)
+	if err != nil {
+		log.Printf("invalid bearer token from [%s]: %s\n", remoteIP, err)
+		if c.JWT.InvalidToken == INVALID_TOKEN_REJECT {
+			return anonymous, errInvalidToken
+		}
+		return anonymous, nil
+	}
+
+	tier := claims.String(c.JWT.TierClaim)
+	if _, ok := c.Tiers[tier]; !ok {
+		tier = c.JWT.DefaultTier
+	}
+	return Identity{Key: "jwt:" + claims.String(c.JWT.SubjectClaim), Tier: tier}, nil
+}
+
+func (c *JWTConfig) verify(token string) (jwt.Claims, error) {
+	claims, err := c.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.String(c.SubjectClaim) == "" {
+		return nil, fmt.Errorf("missing %s claim", c.SubjectClaim)
+	}
+	if c.Issuer != "" && claims.String("iss") != c.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if c.Audience != "" && !hasAudience(claims["aud"], c.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+//The aud claim is either a string or an array of strings
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+//Returns the limit for the identity, its custom limit or the limit of its tier
+//take precedence over the default limit of the scope
+func (c *Config) limitFor(id Identity, settings scopeSettings) int {
+	if id.Limit != 0 {
+		return id.Limit
+	}
+	if limit, ok := c.Tiers[id.Tier]; ok {
+		return limit
+	}
+	return settings.Limit
+}
+
+//Returns whether the request carries Authorization or cookies, so its response
+//may be personalised and must not be shared with other clients
+func hasSession(req *http.Request) bool {
+	return req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != ""
+}
+
+//Returns whether the request carries an API key or a client certificate. Like
+//Authorization, they identify the client, so its responses must not be shared.
+func (c *Config) hasCredentials(req *http.Request) bool {
+	if req.Header.Get(DEFAULT_API_KEY_HEADER) != "" {
+		return true //Upstreams may authenticate by it even when the rate limiter does not
+	}
+	if c.APIKeys != nil && c.APIKeys.keyFrom(req) != "" {
+		return true
+	}
+	return req.TLS != nil && len(req.TLS.PeerCertificates) > 0
+}
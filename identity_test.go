@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func signHS256(secret string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var _ = Describe("Identity", func() {
+	var (
+		cfg *Config
+		req *http.Request
+	)
+
+	BeforeEach(func() {
+		cfg = &Config{
+			Version: CONFIG_VERSION,
+			Limit:   10,
+			Tiers:   map[string]int{"free": 1, "pro": 3},
+			JWT:     &JWTConfig{Secret: "s3cr3t", DefaultTier: "free"},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+		req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	})
+
+	It("limits anonymous requests by IP", func() {
+		id, err := cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).To(Equal(Identity{Key: "10.0.0.1"}))
+	})
+
+	It("limits requests with a valid token by subject and tier", func() {
+		req.Header.Set("Authorization", "Bearer "+signHS256("s3cr3t", map[string]interface{}{"sub": "alice", "plan": "pro"}))
+		id, err := cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).To(Equal(Identity{Key: "jwt:alice", Tier: "pro"}))
+	})
+
+	It("uses the default tier for unknown plans", func() {
+		req.Header.Set("Authorization", "Bearer "+signHS256("s3cr3t", map[string]interface{}{"sub": "bob", "plan": "gold"}))
+		id, err := cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id.Tier).To(Equal("free"))
+	})
+
+	It("falls back to the IP or rejects invalid tokens", func() {
+		req.Header.Set("Authorization", "Bearer "+signHS256("wrong", map[string]interface{}{"sub": "alice"}))
+		id, err := cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).To(Equal(Identity{Key: "10.0.0.1"}))
+
+		cfg.JWT.InvalidToken = INVALID_TOKEN_REJECT
+		_, err = cfg.identify(req, "10.0.0.1")
+		Expect(err).To(Equal(errInvalidToken))
+	})
+
+	It("requires a key to verify tokens", func() {
+		cfg.JWT = &JWTConfig{}
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("secret or a jwks_file")))
+	})
+
+	It("applies the limit of the tier", func() {
+		limiter := NewRateLimiterFromConfig(cfg, nil)
+		pro := Identity{Key: "jwt:alice", Tier: "pro"}
+		for i := 0; i < 3; i++ {
+			Expect(limiter.ExceedsLimitFor(req, pro)).To(BeFalse())
+		}
+		Expect(limiter.ExceedsLimitFor(req, pro)).To(BeTrue())
+		Expect(limiter.ExceedsLimitFor(req, Identity{Key: "10.0.0.1"})).To(BeFalse())
+		Expect(limiter.GetStats()).To(HaveLen(2))
+	})
+})
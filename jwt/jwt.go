@@ -0,0 +1,222 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("malformed token")
+	ErrAlgorithm   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey  = errors.New("no key to verify the token")
+	ErrSignature   = errors.New("invalid signature")
+	ErrExpired     = errors.New("token expired")
+	ErrNotYetValid = errors.New("token not valid yet")
+)
+
+type Claims map[string]interface{}
+
+//Returns a string claim, or "" if the claim is missing or not a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+//Verifier checks HS256 tokens against a shared secret and RS256/ES256 tokens
+//against the public keys of a JWKS document
+type Verifier struct {
+	secret []byte
+	keys   map[string]crypto.PublicKey
+	Leeway time.Duration
+}
+
+func NewVerifier(secret []byte) *Verifier {
+	return &Verifier{
+		secret: secret,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//Adds the RSA and P-256 keys of a JWKS document, other keys are skipped
+func (v *Verifier) AddJWKS(data []byte) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("invalid jwks: %s", err)
+	}
+	for i, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("jwks key %d: %s", i, err)
+		}
+		if key != nil {
+			v.keys[k.Kid] = key
+		}
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+//Verifies the signature and the exp/nbf claims of a compact serialized token
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.verifySignature(h, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := Claims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return nil, ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrNotYetValid
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (v *Verifier) verifySignature(h header, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch h.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return ErrUnknownKey
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrSignature
+		}
+		return nil
+	case "RS256":
+		keys := v.candidates(h.Kid, func(k crypto.PublicKey) bool { _, ok := k.(*rsa.PublicKey); return ok })
+		for _, k := range keys {
+			if rsa.VerifyPKCS1v15(k.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		}
+		return signatureError(keys)
+	case "ES256":
+		keys := v.candidates(h.Kid, func(k crypto.PublicKey) bool { _, ok := k.(*ecdsa.PublicKey); return ok })
+		if len(signature) != 64 {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		for _, k := range keys {
+			if ecdsa.Verify(k.(*ecdsa.PublicKey), digest[:], r, s) {
+				return nil
+			}
+		}
+		return signatureError(keys)
+	}
+	return ErrAlgorithm
+}
+
+//Returns the key with the kid, or all keys of the right type when the token has no kid
+func (v *Verifier) candidates(kid string, accept func(crypto.PublicKey) bool) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for id, k := range v.keys {
+		if (kid == "" || id == kid) && accept(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func signatureError(keys []crypto.PublicKey) error {
+	if len(keys) == 0 {
+		return ErrUnknownKey
+	}
+	return ErrSignature
+}
@@ -0,0 +1,135 @@
+package jwt_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	. "github.com/vipinvkmenon/ratelimit-service/jwt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func segment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func unsigned(alg string, kid string, claims map[string]interface{}) string {
+	return segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+}
+
+func hs256(secret string, claims map[string]interface{}) string {
+	signed := unsigned("HS256", "", claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := unsigned("RS256", kid, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func es256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := unsigned("ES256", kid, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+var _ = Describe("Verifier", func() {
+	var (
+		rsaKey   *rsa.PrivateKey
+		ecKey    *ecdsa.PrivateKey
+		verifier *Verifier
+		claims   map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		verifier = NewVerifier([]byte("s3cr3t"))
+		jwks := fmt.Sprintf(`{"keys": [
+			{"kty": "RSA", "kid": "rsa-1", "n": %q, "e": %q},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": %q, "y": %q},
+			{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"}
+		]}`, encodeInt(rsaKey.N), encodeInt(big.NewInt(int64(rsaKey.E))), encodeInt(ecKey.X), encodeInt(ecKey.Y))
+		Expect(verifier.AddJWKS([]byte(jwks))).To(Succeed())
+
+		claims = map[string]interface{}{"sub": "alice", "plan": "pro", "exp": time.Now().Add(time.Minute).Unix()}
+	})
+
+	It("verifies HS256 tokens", func() {
+		verified, err := verifier.Verify(hs256("s3cr3t", claims))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(verified.String("sub")).To(Equal("alice"))
+		Expect(verified.String("plan")).To(Equal("pro"))
+
+		_, err = verifier.Verify(hs256("wrong", claims))
+		Expect(err).To(Equal(ErrSignature))
+	})
+
+	It("verifies RS256 tokens", func() {
+		_, err := verifier.Verify(rs256(rsaKey, "rsa-1", claims))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifier.Verify(rs256(rsaKey, "", claims))
+		Expect(err).ToNot(HaveOccurred())
+
+		other, _ := rsa.GenerateKey(rand.Reader, 2048)
+		_, err = verifier.Verify(rs256(other, "rsa-1", claims))
+		Expect(err).To(Equal(ErrSignature))
+		_, err = verifier.Verify(rs256(rsaKey, "unknown", claims))
+		Expect(err).To(Equal(ErrUnknownKey))
+	})
+
+	It("verifies ES256 tokens", func() {
+		_, err := verifier.Verify(es256(ecKey, "ec-1", claims))
+		Expect(err).ToNot(HaveOccurred())
+
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		_, err = verifier.Verify(es256(other, "ec-1", claims))
+		Expect(err).To(Equal(ErrSignature))
+	})
+
+	It("rejects expired and not yet valid tokens", func() {
+		claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		_, err := verifier.Verify(hs256("s3cr3t", claims))
+		Expect(err).To(Equal(ErrExpired))
+
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		claims["nbf"] = time.Now().Add(time.Minute).Unix()
+		_, err = verifier.Verify(hs256("s3cr3t", claims))
+		Expect(err).To(Equal(ErrNotYetValid))
+	})
+
+	It("rejects malformed tokens and unsupported algorithms", func() {
+		_, err := verifier.Verify("not-a-token")
+		Expect(err).To(Equal(ErrMalformed))
+		_, err = verifier.Verify(unsigned("none", "", claims) + ".")
+		Expect(err).To(Equal(ErrAlgorithm))
+	})
+})
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	PRIORITY_CRITICAL = "critical"
+	PRIORITY_HIGH     = "high"
+	PRIORITY_NORMAL   = "normal"
+	PRIORITY_LOW      = "low"
+
+	DEFAULT_EARLY_DROP = 80 //Utilisation percentage at which low priority requests start being shed
+)
+
+//Priorities from lowest to highest, shed in this order
+var priorities = []string{PRIORITY_LOW, PRIORITY_NORMAL, PRIORITY_HIGH, PRIORITY_CRITICAL}
+
+var loadShedder = NewLoadShedder()
+
+//LoadSheddingConfig caps the requests in flight to all upstreams and sheds
+//requests by priority when the proxy is overloaded. Above early_drop percent of
+//the capacity, requests are dropped with a probability that rises with the
+//utilisation, low priorities first. Critical requests are only shed once the
+//capacity is reached.
+//
+//The priority of a request is that of the matching rule, else the priority
+//header, else that of the tier of the client, else the default.
+//
+//	load_shedding:
+//	  capacity: 500
+//	  priority_header: X-Priority
+//	  tiers:
+//	    free: low
+//	    enterprise: high
+//	rules:
+//	  - name: checkout
+//	    limit: 100
+//	    priority: critical
+type LoadSheddingConfig struct {
+	Capacity        int               `json:"capacity" yaml:"capacity"`                                   //Requests in flight to upstreams
+	EarlyDrop       int               `json:"early_drop,omitempty" yaml:"early_drop,omitempty"`           //Utilisation percentage
+	PriorityHeader  string            `json:"priority_header,omitempty" yaml:"priority_header,omitempty"` //Disabled when unset
+	Tiers           map[string]string `json:"tiers,omitempty" yaml:"tiers,omitempty"`                     //Priority of the clients of a tier
+	DefaultPriority string            `json:"default_priority,omitempty" yaml:"default_priority,omitempty"`
+}
+
+func (c *LoadSheddingConfig) validate() error {
+	if c.Capacity < 1 {
+		return errors.New("capacity must be at least 1")
+	}
+	if c.EarlyDrop == 0 {
+		c.EarlyDrop = DEFAULT_EARLY_DROP
+	}
+	if c.EarlyDrop < 0 || c.EarlyDrop > 100 {
+		return fmt.Errorf("early_drop must be between 0 and 100, got %d", c.EarlyDrop)
+	}
+	if c.DefaultPriority == "" {
+		c.DefaultPriority = PRIORITY_NORMAL
+	}
+	if err := validatePriority(c.DefaultPriority); err != nil {
+		return fmt.Errorf("default_priority: %s", err)
+	}
+	for tier, priority := range c.Tiers {
+		if err := validatePriority(priority); err != nil {
+			return fmt.Errorf("tier %s: %s", tier, err)
+		}
+	}
+	return nil
+}
+
+func validatePriority(priority string) error {
+	if priorityRank(priority) < 0 {
+		return fmt.Errorf("unknown priority %q", priority)
+	}
+	return nil
+}
+
+//Returns the rank of the priority, 0 for the lowest and -1 for unknown priorities
+func priorityRank(priority string) int {
+	for rank, p := range priorities {
+		if p == priority {
+			return rank
+		}
+	}
+	return -1
+}
+
+//Returns the priority of the request
+func (c *LoadSheddingConfig) priorityOf(req *http.Request, rule *Rule, identity Identity) string {
+	if rule != nil && rule.Priority != "" {
+		return rule.Priority
+	}
+	if c.PriorityHeader != "" {
+		if priority := req.Header.Get(c.PriorityHeader); priorityRank(priority) >= 0 {
+			return priority
+		}
+	}
+	if priority, ok := c.Tiers[identity.Tier]; ok {
+		return priority
+	}
+	return c.DefaultPriority
+}
+
+//Returns the probability of shedding a request of the priority at the utilisation
+//in percent. The range from early_drop to 100 is split into one band per priority
+//below critical, within its band the probability rises from 0 to 1.
+func (c *LoadSheddingConfig) dropProbability(priority string, utilisation float64) float64 {
+	if utilisation >= 100 {
+		return 1
+	}
+	rank := priorityRank(priority)
+	if rank == len(priorities)-1 {
+		return 0
+	}
+	band := float64(100-c.EarlyDrop) / float64(len(priorities)-1)
+	start := float64(c.EarlyDrop) + float64(rank)*band
+	switch {
+	case utilisation < start:
+		return 0
+	case utilisation >= start+band:
+		return 1
+	}
+	return (utilisation - start) / band
+}
+
+//LoadShedder counts the requests in flight to upstreams
+type LoadShedder struct {
+	inFlight int
+	stats    map[string]*PriorityStat
+	sync.Mutex
+}
+
+//PriorityStat are the requests of a priority reported in /stats/load-shedding
+type PriorityStat struct {
+	Admitted int64 `json:"admitted"`
+	Shed     int64 `json:"shed"`
+}
+
+//LoadStats are reported in /stats/load-shedding
+type LoadStats struct {
+	InFlight   int                     `json:"in_flight"`
+	Priorities map[string]PriorityStat `json:"priorities"`
+}
+
+func NewLoadShedder() *LoadShedder {
+	stats := make(map[string]*PriorityStat)
+	for _, p := range priorities {
+		stats[p] = &PriorityStat{}
+	}
+	return &LoadShedder{stats: stats}
+}
+
+//Admits a request of the priority, returns false when it is shed. Admitted
+//requests must be released once done.
+func (s *LoadShedder) Admit(c *LoadSheddingConfig, priority string) bool {
+	s.Lock()
+	defer s.Unlock()
+	utilisation := float64(s.inFlight) * 100 / float64(c.Capacity)
+	if p := c.dropProbability(priority, utilisation); p > 0 && (p >= 1 || randFloat() < p) {
+		s.stats[priority].Shed++
+		return false
+	}
+	s.inFlight++
+	s.stats[priority].Admitted++
+	return true
+}
+
+func (s *LoadShedder) Release() {
+	s.Lock()
+	defer s.Unlock()
+	s.inFlight--
+}
+
+func (s *LoadShedder) Stats() LoadStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := LoadStats{InFlight: s.inFlight, Priorities: make(map[string]PriorityStat)}
+	for p, stat := range s.stats {
+		stats.Priorities[p] = *stat
+	}
+	return stats
+}
+
+func loadSheddingStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(loadShedder.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
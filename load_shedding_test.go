@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load shedding", func() {
+	var cfg *LoadSheddingConfig
+
+	BeforeEach(func() {
+		cfg = &LoadSheddingConfig{Capacity: 10, EarlyDrop: 40, PriorityHeader: "X-Priority", Tiers: map[string]string{"free": PRIORITY_LOW}}
+		Expect(cfg.validate()).To(Succeed())
+		loadShedder = NewLoadShedder()
+	})
+
+	It("drops low priorities first as the utilisation rises", func() {
+		Expect(cfg.dropProbability(PRIORITY_LOW, 30)).To(Equal(0.0))
+		Expect(cfg.dropProbability(PRIORITY_LOW, 50)).To(Equal(0.5))
+		Expect(cfg.dropProbability(PRIORITY_LOW, 60)).To(Equal(1.0))
+		Expect(cfg.dropProbability(PRIORITY_NORMAL, 60)).To(Equal(0.0))
+		Expect(cfg.dropProbability(PRIORITY_NORMAL, 70)).To(Equal(0.5))
+		Expect(cfg.dropProbability(PRIORITY_HIGH, 90)).To(Equal(0.5))
+		Expect(cfg.dropProbability(PRIORITY_CRITICAL, 99)).To(Equal(0.0))
+		Expect(cfg.dropProbability(PRIORITY_CRITICAL, 100)).To(Equal(1.0))
+	})
+
+	It("sheds requests above the capacity, critical ones last", func() {
+		for i := 0; i < 6; i++ {
+			Expect(loadShedder.Admit(cfg, PRIORITY_NORMAL)).To(BeTrue())
+		}
+		Expect(loadShedder.Admit(cfg, PRIORITY_LOW)).To(BeFalse())
+		for i := 0; i < 4; i++ {
+			Expect(loadShedder.Admit(cfg, PRIORITY_CRITICAL)).To(BeTrue())
+		}
+		Expect(loadShedder.Admit(cfg, PRIORITY_CRITICAL)).To(BeFalse())
+		loadShedder.Release()
+		Expect(loadShedder.Admit(cfg, PRIORITY_CRITICAL)).To(BeTrue())
+
+		stats := loadShedder.Stats()
+		Expect(stats.InFlight).To(Equal(10))
+		Expect(stats.Priorities[PRIORITY_LOW]).To(Equal(PriorityStat{Shed: 1}))
+		Expect(stats.Priorities[PRIORITY_CRITICAL]).To(Equal(PriorityStat{Admitted: 5, Shed: 1}))
+	})
+
+	It("takes the priority from the rule, the header, the tier or the default", func() {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		Expect(cfg.priorityOf(req, nil, Identity{})).To(Equal(PRIORITY_NORMAL))
+		Expect(cfg.priorityOf(req, nil, Identity{Tier: "free"})).To(Equal(PRIORITY_LOW))
+		req.Header.Set("X-Priority", "high")
+		Expect(cfg.priorityOf(req, nil, Identity{Tier: "free"})).To(Equal(PRIORITY_HIGH))
+		Expect(cfg.priorityOf(req, &Rule{Priority: PRIORITY_CRITICAL}, Identity{})).To(Equal(PRIORITY_CRITICAL))
+		req.Header.Set("X-Priority", "urgent")
+		Expect(cfg.priorityOf(req, nil, Identity{})).To(Equal(PRIORITY_NORMAL))
+	})
+
+	It("rejects unknown priorities", func() {
+		Expect((&LoadSheddingConfig{Capacity: 1, DefaultPriority: "urgent"}).validate()).NotTo(Succeed())
+		Expect((&LoadSheddingConfig{Capacity: 0}).validate()).NotTo(Succeed())
+		Expect(validateRules([]Rule{{Name: "r", Limit: 1, Priority: "urgent"}})).NotTo(Succeed())
+	})
+
+	It("answers shed requests with 503 and releases forwarded ones when their body is closed", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		cfg.Capacity = 1
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, LoadShedding: cfg}, nil)
+		proxy := newProxy()
+
+		send := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			return w
+		}
+		Expect(send().Code).To(Equal(200))
+		Expect(send().Code).To(Equal(200))
+		Expect(loadShedder.Stats().InFlight).To(Equal(0))
+
+		loadShedder.Admit(cfg, PRIORITY_CRITICAL)
+		w := send()
+		Expect(w.Code).To(Equal(503))
+		Expect(w.Header().Get("Retry-After")).To(Equal("1"))
+	})
+})
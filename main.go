@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -29,55 +30,140 @@ const (
 )
 
 var (
-	limit       int
 	rateLimiter *RateLimiter
-	delay       int
 )
 
 func main() {
 	log.SetOutput(os.Stdout)
 
-	limit = getEnv("RATE_LIMIT", DEFAULT_LIMIT)
-	delay = getEnv("DURATION", DEFAULT_LIMIT)
-	log.Printf("limit per sec %d\n", limit)
-	log.Printf("Set Delay %d milliseconds\n", delay)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	log.Printf("limit per sec %d\n", cfg.Limit)
 
-	rateLimiter = NewRateLimiter(limit)
+	applyConfig(cfg)
+	watchConfig()
 
 	//Routes
+	http.HandleFunc("/health", healthHandler) //Not-ready while draining on shutdown
 	http.HandleFunc("/stats", statsHandler)
 	http.Handle("/", newProxy())                       //Simple End point for RL service can be used with when using RL as CUPS
 	http.Handle("/service-instance/", brokeredProxy()) //When using the RL as a brokered service
 	http.HandleFunc("/config", onTheFlyConfig)         // To change ratelimit and delays on the fly
-	log.Fatal(http.ListenAndServe(":"+getPort(), nil))
+	http.HandleFunc("/stats/api-keys", adminOnly(keyUsageHandler))
+	http.HandleFunc("/stats/geo", geoStatsHandler)
+	http.HandleFunc("/stats/destinations", policyStatsHandler)
+	http.HandleFunc("/stats/circuit-breakers", breakerStatsHandler)
+	http.HandleFunc("/stats/retries", retryStatsHandler)
+	http.HandleFunc("/stats/load-shedding", loadSheddingStatsHandler)
+	http.HandleFunc("/stats/queue", queueStatsHandler)
+	http.HandleFunc("/stats/cache", cacheStatsHandler)
+	http.HandleFunc("/stats/coalescing", coalesceStatsHandler)
+	http.HandleFunc("/stats/connections", upgradeStatsHandler)
+	http.HandleFunc("/api-keys", adminOnly(apiKeysHandler)) //Manage the API key registry
+	http.HandleFunc("/api-keys/", adminOnly(apiKeysHandler))
+	http.HandleFunc("/faults", adminOnly(faultsHandler)) //Change the injected faults at runtime
+	listener, err := net.Listen("tcp", ":"+getPort())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	server := cfg.newServer(listener.Addr().String(), nil)
+	drained := cfg.shutdownOnSignal(server)
+	serve := func(l net.Listener) {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	if cfg.TLS == nil {
+		go serve(cfg.limitListener(listener))
+	} else {
+		if cfg.TLS.Port != "" {
+			go serve(cfg.limitListener(listener))
+			if listener, err = net.Listen("tcp", ":"+cfg.TLS.Port); err != nil {
+				log.Fatalln(err.Error())
+			}
+		}
+		log.Printf("Serving HTTPS on %s", listener.Addr())
+		go serve(cfg.TLS.listener(cfg.limitListener(listener)))
+	}
+	<-drained
 }
 
 func newProxy() http.Handler {
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			forwardedURL := req.Header.Get(CF_FORWARDED_URL)
-
-			url, err := url.Parse(forwardedURL)
-			if err != nil {
-				log.Fatalln(err.Error())
-			}
+			//The forwarded URL was validated before the request reached the proxy
+			url, _ := forwardedURL(req)
 
 			req.URL = url
 			req.Host = url.Host
 
 		},
-		Transport: newRateLimitedRoundTripper(),
+		Transport:     newRateLimitedRoundTripper(),
+		ErrorHandler:  proxyErrorHandler,
+		FlushInterval: flushInterval(),
 	}
-	return proxy
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := forwardedURL(req); err != nil {
+			log.Printf("Bad request: %s\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		proxy.ServeHTTP(w, req)
+	})
 }
 
+//Returns the URL the gorouter forwards the request to
+func forwardedURL(req *http.Request) (*url.URL, error) {
+	forwarded := req.Header.Get(CF_FORWARDED_URL)
+	if forwarded == "" {
+		return nil, fmt.Errorf("missing %s header", CF_FORWARDED_URL)
+	}
+	u, err := url.Parse(forwarded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %s", CF_FORWARDED_URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s header: %q is not an absolute http(s) url", CF_FORWARDED_URL, forwarded)
+	}
+	return u, nil
+}
+
+//Answers upstream timeouts with 504 and other upstream failures with 502
+func proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusBadGateway
+	var tooLarge *http.MaxBytesError
+	var denied *PolicyError
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	} else if errors.As(err, &tooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	} else if errors.As(err, &denied) { //The host resolved to an address the destination policy denies
+		status = http.StatusForbidden
+	}
+	log.Printf("Upstream request to [%s] failed with %d: %s\n", req.URL.Host, status, err)
+	if isGRPC(req) {
+		setGRPCStatus(w.Header(), status, rejectionTitle(status), 0)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+//Reports all stats, or those of one service instance/binding with ?instance=<id>&binding=<id>
+//or of one destination with ?destination=<host>
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	stats, err := json.Marshal(rateLimiter.GetStats())
+	all := currentRateLimiter().GetStats()
+	if scope := queryScope(r); scope != (Scope{}) {
+		all = all.ForScope(scope)
+	}
+	stats, err := json.Marshal(all)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	fmt.Fprintf(w, string(stats))
+	fmt.Fprintf(w, "%s", stats)
 }
 
 func getPort() string {
@@ -113,87 +199,241 @@ func getEnv(env string, defaultValue int) int {
 }
 
 type RateLimitedRoundTripper struct {
-	rateLimiter *RateLimiter
-	transport   http.RoundTripper
+	transports *transportPool
 }
 
 func newRateLimitedRoundTripper() *RateLimitedRoundTripper {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipSslValidation()},
-	}
 	return &RateLimitedRoundTripper{
-		rateLimiter: rateLimiter,
-		transport:   tr,
+		transports: upstreamTransports,
 	}
 }
 
-func (r *RateLimitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	var err error
-	var res *http.Response
-
+func (r *RateLimitedRoundTripper) RoundTrip(req *http.Request) (res *http.Response, err error) {
 	remoteIP := strings.Split(req.RemoteAddr, ":")[0]
-
+	rateLimiter := currentRateLimiter()
 	log.Printf("request from [%s]\n", remoteIP)
-	if r.rateLimiter.ExceedsLimit(remoteIP) {
-		resp := &http.Response{
-			StatusCode: 429,
-			Body:       ioutil.NopCloser(bytes.NewBufferString("Too many requests")),
+	if err := rateLimiter.Config().verifySignature(req); err != nil {
+		log.Printf("Rejected request from [%s]: %s\n", remoteIP, err)
+		return rateLimiter.Config().reject(req, 403, Decision{}), nil
+	}
+	if err := rateLimiter.Config().DestinationPolicy.Check(req.URL); err != nil {
+		policyUsage.Record(err.(*PolicyError).Reason)
+		log.Printf("Rejected request from [%s] to [%s]: %s\n", remoteIP, req.URL.Host, err)
+		return rateLimiter.Config().reject(req, 403, Decision{}), nil
+	}
+
+	geo := rateLimiter.Config().lookupGeo(remoteIP)
+	req = withGeo(req, geo)
+
+	identity, err := rateLimiter.Identify(req, remoteIP)
+	if err != nil {
+		resp := rateLimiter.Config().reject(req, 401, Decision{})
+		if err == errInvalidToken {
+			resp.Header.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 		}
-		log.Printf("Too many requests")
+		log.Printf("Unauthorized")
 		return resp, nil
 	}
+	decision := rateLimiter.Decide(req, identity)
+	if identity.KeyID != "" {
+		keyRegistry.Record(identity.KeyID, !decision.Allowed)
+	}
+	geoUsage.Record(geo, !decision.Allowed)
+	if decision.Blocked {
+		log.Printf("Blocked by rule [%s]", decision.Rule.Name)
+		return rateLimiter.Config().reject(req, decision.Status(), decision), nil
+	}
+	if !decision.Allowed {
+		log.Printf("Too many requests")
+		if resp := rateLimiter.Config().stale(req, WARNING_STALE); resp != nil {
+			return resp, nil
+		}
+		return rateLimiter.Config().reject(req, decision.Status(), decision), nil
+	}
+
+	if limitBody(req, rateLimiter.Config().maxBodyFor(decision.Rule)) {
+		log.Printf("Request body of [%d] bytes is too large", req.ContentLength)
+		return rateLimiter.Config().reject(req, http.StatusRequestEntityTooLarge, Decision{}), nil
+	}
+
+	faults := faultsFor(req, decision.Rule, rateLimiter.FaultsFor(req))
+	if faults.Abort != 0 {
+		log.Printf("Aborting request with injected fault [%d]", faults.Abort)
+		if isGRPC(req) {
+			return grpcResponse(faults.Abort, "Injected fault", 0), nil
+		}
+		return abortResponse(faults.Abort), nil
+	}
+	if isUpgrade(req) { //Counted while open, to limit them and to drain them on shutdown
+		streaming := rateLimiter.Config().Streaming
+		if streaming == nil {
+			streaming = &StreamingConfig{}
+		}
+		if !upgrades.Acquire(identity.Key, streaming.MaxConnections) {
+			log.Printf("Too many upgraded connections from [%s]", identity.Key)
+			return rateLimiter.Config().reject(req, 429, Decision{}), nil
+		}
+		defer func() {
+			if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+				upgrades.Release(identity.Key)
+				return
+			}
+			conn, ok := res.Body.(io.ReadWriteCloser)
+			if !ok { //The proxy cannot copy what the client sends to a read-only body
+				res.Body.Close()
+				upgrades.Release(identity.Key)
+				res, err = nil, errors.New("upstream switched protocols without a writable connection")
+				return
+			}
+			if streaming.MessageRate > 0 {
+				conn = newMessageLimiter(conn, streaming)
+			}
+			res.Body = onClose(conn, func() { upgrades.Release(identity.Key) })
+		}()
+	}
+	release := func() {} //Releases the admission of the request once done
+	if shedding := rateLimiter.Config().LoadShedding; shedding != nil {
+		priority := shedding.priorityOf(req, decision.Rule, identity)
+		if !loadShedder.Admit(shedding, priority) {
+			log.Printf("Shedding %s priority request to [%s]", priority, req.URL.Host)
+			if resp := rateLimiter.Config().stale(req, WARNING_STALE); resp != nil {
+				return resp, nil
+			}
+			resp := rateLimiter.Config().reject(req, 503, Decision{})
+			resp.Header.Set("Retry-After", "1")
+			return resp, nil
+		}
+		release = loadShedder.Release
+	}
+	if queue := rateLimiter.Config().FairQueue; queue != nil {
+		if err := fairQueue.Acquire(req.Context(), queue, identity); err != nil {
+			release()
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			log.Printf("Rejected request from [%s]: %s", identity.Key, err)
+			if resp := rateLimiter.Config().stale(req, WARNING_STALE); resp != nil {
+				return resp, nil
+			}
+			resp := rateLimiter.Config().reject(req, 503, Decision{})
+			resp.Header.Set("Retry-After", "1")
+			return resp, nil
+		}
+		shed := release
+		release = func() {
+			fairQueue.Release()
+			shed()
+		}
+	}
+	breakerConfig := rateLimiter.Config().CircuitBreaker
+	var breaker *Breaker
+	if breakerConfig != nil {
+		breaker = circuitBreakers.Get(req.URL.Host)
+		if ok, wait := breaker.allow(breakerConfig, time.Now()); !ok {
+			log.Printf("Circuit breaker for [%s] is open", req.URL.Host)
+			release()
+			if resp := rateLimiter.Config().stale(req, WARNING_REVALIDATION_FAILED); resp != nil {
+				return resp, nil
+			}
+			resp := rateLimiter.Config().reject(req, 503, Decision{})
+			resp.Header.Set("Retry-After", strconv.Itoa(seconds(wait)))
+			return resp, nil
+		}
+	}
+	if faults.Before > 0 {
+		delayInMilliseconds(req.Context(), faults.Before)
+	}
 
-	res, err = r.transport.RoundTrip(req)
+	forwarded := false
+	res, err = rateLimiter.Config().coalesce(req, func() (*http.Response, error) {
+		forwarded = true
+		return r.forward(req, rateLimiter.Config(), decision.Rule, breaker)
+	})
+	if !forwarded && breaker != nil {
+		breaker.release() //The response of an identical request was shared
+	}
+	if err != nil || res.StatusCode >= 500 {
+		if resp := rateLimiter.Config().stale(req, WARNING_REVALIDATION_FAILED); resp != nil {
+			discard(res)
+			release()
+			return resp, nil
+		}
+	}
 	if err != nil {
+		release()
 		return nil, err
 	}
+	if isStream(res) {
+		release() //Streams are limited by their connections rather than as requests in flight
+	} else {
+		res.Body = onClose(res.Body, release)
+	}
+	rateLimiter.Config().cache(req, res)
+	rateLimiter.Config().setRateLimitHeaders(res.Header, decision, time.Now())
 
-	//DELAY Method
-	delayInMilliseconds(delay)
+	//DELAY Method, streams are not held back once the upstream responded
+	if !isStream(res) {
+		delayInMilliseconds(req.Context(), faults.After)
+	}
 
 	return res, err
 }
 
-// Adds delay to processing the request
-func delayInMilliseconds(duration int) {
+// Adds delay to processing the request, unless the client goes away
+func delayInMilliseconds(ctx context.Context, duration int) {
 	log.Printf("Adding Delay of [%d] milliseconds to the request", duration)
-	time.Sleep(time.Duration(duration) * time.Millisecond)
+	timer := time.NewTimer(time.Duration(duration) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
 }
 
-//Simple API to change LIMIT and DELAY on demand
+//Simple API to change LIMIT and DELAY on demand, for a single service instance/binding with ?instance=<id>&binding=<id>
+//or for a single destination with ?destination=<host>
 func onTheFlyConfig(w http.ResponseWriter, r *http.Request) {
 
-	var oldDelay = delay
-	var oldLimit = limit
+	var (
+		newLimit int
+		delay    *int
+	)
+	scope := queryScope(r)
 
 	delayVal := r.URL.Query().Get("DELAY")
 	rateLimitVal := r.URL.Query().Get("LIMIT")
 
 	if delayVal != "" {
 		newDelay, err := strconv.Atoi(delayVal)
-		if err != nil {
-
-			log.Printf("Invalid delay value, setting to default")
-			delay = oldDelay
+		if err != nil || newDelay < 0 {
+			log.Printf("Invalid delay value, keeping current value")
 		} else {
 			log.Printf("Setting Delay: [%d] milliseconds ", newDelay)
-			delay = newDelay
+			delay = &newDelay
 
 		}
 	}
 	if rateLimitVal != "" {
-		newLimit, err := strconv.Atoi(rateLimitVal)
-		if err != nil {
-			log.Printf("Invalid Limit value, setting to default")
-			limit = oldLimit
+		limit, err := strconv.Atoi(rateLimitVal)
+		if err != nil || validateLimit(limit) != nil {
+			log.Printf("Invalid Limit value, keeping current value")
 		} else {
-			log.Printf("Setting Rate Limit Value : [%d]", newLimit)
-
-			limit = newLimit
-			rateLimiter = NewRateLimiter(limit)
+			log.Printf("Setting Rate Limit Value : [%d]", limit)
+			newLimit = limit
 		}
 	}
 
+	updateConfig(func(c *Config) *Config { return c.withOverride(scope, newLimit, delay) })
+}
+
+func queryScope(r *http.Request) Scope {
+	scope := Scope{ServiceInstance: r.URL.Query().Get("instance")}
+	if scope.ServiceInstance != "" {
+		scope.Binding = r.URL.Query().Get("binding")
+	} else {
+		scope.Destination = r.URL.Query().Get("destination")
+	}
+	return scope
 }
 
 //Function to handle RL & Delay when using the service as a brokered service.
@@ -202,21 +442,11 @@ func brokeredProxy() http.Handler {
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 
-			forwardedURL := req.Header.Get(CF_FORWARDED_URL)
 			proxySignature := req.Header.Get(CF_PROXY_SIGNATURE)
 			proxyMetadata := req.Header.Get(CF_PROXY_METADATA)
-			//the request url will be in the format /service-instance/<ServiceInstanceID>/bind-instance/<BindInstanceID>
-			//While currently not used for anythingg other than for logging this data can be used later
-			path := req.URL.Path
-			servInstance := strings.Split(path, "/")[2]
-			log.Printf("Serv Instance " + servInstance)
-			bindInstance := strings.Split(path, "/")[4]
-			log.Printf("Bind Instance " + bindInstance)
-
-			url, err := url.Parse(forwardedURL)
-			if err != nil {
-				log.Fatalln(err.Error())
-			}
+
+			//The forwarded URL was validated before the request reached the proxy
+			url, _ := forwardedURL(req)
 
 			req.URL = url
 			req.Host = url.Host
@@ -225,7 +455,35 @@ func brokeredProxy() http.Handler {
 			req.Header.Set(CF_PROXY_METADATA, proxyMetadata)
 
 		},
-		Transport: newRateLimitedRoundTripper(),
+		Transport:     newRateLimitedRoundTripper(),
+		ErrorHandler:  proxyErrorHandler,
+		FlushInterval: flushInterval(),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		//Limits, stats and config are scoped to the service instance and optionally to the binding
+		scope, err := brokeredScope(req.URL.Path)
+		if err != nil {
+			log.Printf("Bad request: %s\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Serv Instance %s", scope.ServiceInstance)
+		log.Printf("Bind Instance %s", scope.Binding)
+		if _, err := forwardedURL(req); err != nil {
+			log.Printf("Bad request: %s\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		proxy.ServeHTTP(w, withScope(req, scope))
+	})
+}
+
+//Parses a brokered path, in the format /service-instance/<ServiceInstanceID>/bind-instance/<BindInstanceID>
+func brokeredScope(path string) (Scope, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 5 || parts[1] != "service-instance" || parts[3] != "bind-instance" || parts[2] == "" || parts[4] == "" {
+		return Scope{}, fmt.Errorf("malformed path %q, expected /service-instance/<id>/bind-instance/<id>", path)
 	}
-	return proxy
+	return Scope{ServiceInstance: parts[2], Binding: parts[4]}, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy", func() {
+	var (
+		backend *httptest.Server
+		serve   func(handler http.Handler, path string, forwarded string) *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		rateLimiter = NewRateLimiter(100)
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		serve = func(handler http.Handler, path string, forwarded string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com"+path, nil)
+			if forwarded != "" {
+				req.Header.Set(CF_FORWARDED_URL, forwarded)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	It("forwards requests to the forwarded url", func() {
+		Expect(serve(newProxy(), "/", backend.URL+"/app").Code).To(Equal(http.StatusTeapot))
+		Expect(serve(brokeredProxy(), "/service-instance/si/bind-instance/b", backend.URL).Code).To(Equal(http.StatusTeapot))
+	})
+
+	It("rejects missing and invalid forwarded urls with 400", func() {
+		Expect(serve(newProxy(), "/", "").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(newProxy(), "/", "%zz").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(newProxy(), "/", "/relative").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(brokeredProxy(), "/service-instance/si/bind-instance/b", "ftp://example.com").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("rejects malformed brokered paths with 400", func() {
+		for _, path := range []string{"/service-instance/", "/service-instance/si", "/service-instance/si/bind-instance/", "/service-instance/si/other/b"} {
+			Expect(serve(brokeredProxy(), path, backend.URL).Code).To(Equal(http.StatusBadRequest), path)
+		}
+		scope, err := brokeredScope("/service-instance/si/bind-instance/b")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(scope).To(Equal(Scope{ServiceInstance: "si", Binding: "b"}))
+	})
+
+	It("answers upstream connection failures with 502", func() {
+		url := backend.URL
+		backend.Close()
+		Expect(serve(newProxy(), "/", url).Code).To(Equal(http.StatusBadGateway))
+	})
+
+	It("answers upstream timeouts with 504", func() {
+		req := httptest.NewRequest("GET", backend.URL, nil)
+		w := httptest.NewRecorder()
+		proxyErrorHandler(w, req, context.DeadlineExceeded)
+		Expect(w.Code).To(Equal(http.StatusGatewayTimeout))
+	})
+})
@@ -2,30 +2,254 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/vipinvkmenon/ratelimit-service/store"
 )
 
+const (
+	SCOPE_IDLE_TTL = 5 * time.Minute //Scopes idle for longer are evicted, their buckets expired long before
+	MAX_SCOPES     = 10000           //Beyond it, scopes the config does not name share the budgets of the enclosing scope
+)
+
 type Stats []Stat
 type Stat struct {
 	Ip        string `json:"ip"`
 	Available int    `json:"available"`
+	Rule      string `json:"rule,omitempty"`
+	Scope
 }
 
 type RateLimiter struct {
 	duration time.Duration
+	config   *Config
+	scopes   map[Scope]*scopeLimiter
+	prunedAt time.Time
+	sync.Mutex
+}
+
+//The stores backing the budgets of one scope
+type scopeLimiter struct {
+	settings scopeSettings
 	store    store.Store
+	rules    []*ruleLimiter
+	limits   map[int]store.Store //Stores for tiers and custom limits other than the default
+	usedAt   time.Time           //Guarded by the RateLimiter
+	sync.Mutex
+}
+
+type ruleLimiter struct {
+	rule  Rule
+	store store.Store //nil for rules that block or exempt
+}
+
+//Decision is the outcome of limiting a request, with the state of the bucket
+//that decided it. Limit is zero when no bucket was involved.
+type Decision struct {
+	Rule    *Rule //The matching rule, nil when the default limit applied
+	Blocked bool  //Rejected by a blocking rule rather than by a limit
+	store.Result
 }
 
 func NewRateLimiter(limit int) *RateLimiter {
-	return &RateLimiter{
-		store: store.NewStore(limit),
+	return NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: limit}, nil)
+}
+
+//Builds a RateLimiter for the config. Buckets of the previous RateLimiter are
+//carried over for every scope whose default limit or rules did not change.
+func NewRateLimiterFromConfig(cfg *Config, previous *RateLimiter) *RateLimiter {
+	r := &RateLimiter{
+		config: cfg,
+		scopes: make(map[Scope]*scopeLimiter),
+	}
+	if previous != nil {
+		previous.Lock()
+		for scope, old := range previous.scopes {
+			if resolved, settings := cfg.resolve(scope); resolved == scope {
+				r.scopes[scope] = newScopeLimiter(settings, old)
+				r.scopes[scope].usedAt = old.usedAt
+			}
+		}
+		previous.Unlock()
+	}
+	if _, ok := r.scopes[Scope{}]; !ok {
+		_, settings := cfg.resolve(Scope{})
+		r.scopes[Scope{}] = newScopeLimiter(settings, nil)
+	}
+	return r
+}
+
+//Builds a scopeLimiter for the settings, reusing the stores of previous that still apply
+func newScopeLimiter(settings scopeSettings, previous *scopeLimiter) *scopeLimiter {
+	sl := &scopeLimiter{
+		settings: settings,
+		limits:   make(map[int]store.Store),
+	}
+	if previous != nil && previous.settings.Limit == settings.Limit {
+		sl.store = previous.store
+	} else {
+		sl.store = store.NewStore(settings.Limit)
+	}
+	if previous != nil {
+		previous.Lock()
+		for limit, s := range previous.limits {
+			if limit != settings.Limit {
+				sl.limits[limit] = s
+			}
+		}
+		previous.Unlock()
+	}
+
+	for _, rule := range settings.Rules {
+		rl := &ruleLimiter{rule: rule}
+		if old := previous.ruleLimiter(rule.Name); old != nil && reflect.DeepEqual(old.rule, rule) {
+			rl.store = old.store
+		} else if rule.Action == "" || rule.Action == ACTION_LIMIT {
+			rl.store = store.NewStore(rule.Limit)
+		}
+		sl.rules = append(sl.rules, rl)
+	}
+	return sl
+}
+
+//Returns the store for the limit, creating it on first use
+func (s *scopeLimiter) storeFor(limit int) store.Store {
+	if limit == s.settings.Limit {
+		return s.store
+	}
+	s.Lock()
+	defer s.Unlock()
+	st, ok := s.limits[limit]
+	if !ok {
+		st = store.NewStore(limit)
+		s.limits[limit] = st
+	}
+	return st
+}
+
+func (s *scopeLimiter) ruleLimiter(name string) *ruleLimiter {
+	if s == nil {
+		return nil
+	}
+	for _, rl := range s.rules {
+		if rl.rule.Name == name {
+			return rl
+		}
+	}
+	return nil
+}
+
+func (r *RateLimiter) Config() *Config {
+	return r.config
+}
+
+//Returns the limiter of the scope the request belongs to, creating it on first use
+func (r *RateLimiter) scopeLimiter(req *http.Request) *scopeLimiter {
+	scope, settings := r.config.resolve(r.config.scopeOf(req))
+	now := time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+	sl, ok := r.scopes[scope]
+	if !ok && now.Sub(r.prunedAt) > SCOPE_IDLE_TTL {
+		r.prune(now) //Before the cap, so idle scopes make room for new ones
+	}
+	for !ok && len(r.scopes) >= MAX_SCOPES && !r.config.configured(scope) {
+		scope, settings = r.config.resolve(scope.parent())
+		sl, ok = r.scopes[scope]
+	}
+	if !ok {
+		sl = newScopeLimiter(settings, nil)
+		r.scopes[scope] = sl
+	}
+	sl.usedAt = now
+	return sl
+}
+
+//Evicts the scopes other than the default one that were idle for longer than
+//SCOPE_IDLE_TTL and closes their stores. Scopes are created per service
+//instance, binding or destination a request names, evicted scopes are created
+//again on their next request.
+func (r *RateLimiter) prune(now time.Time) {
+	r.prunedAt = now
+	for scope, sl := range r.scopes {
+		if scope != (Scope{}) && now.Sub(sl.usedAt) > SCOPE_IDLE_TTL {
+			delete(r.scopes, scope)
+			sl.close()
+		}
+	}
+}
+
+//Closes the stores of the scope
+func (s *scopeLimiter) close() {
+	s.store.Close()
+	for _, rl := range s.rules {
+		if rl.store != nil {
+			rl.store.Close()
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, st := range s.limits {
+		st.Close()
 	}
 }
 
 func (r *RateLimiter) ExceedsLimit(ip string) bool {
-	if _, err := r.store.Increment(ip); err != nil {
+	r.Lock()
+	sl := r.scopes[Scope{}]
+	r.Unlock()
+	return exceeds(sl.store, ip)
+}
+
+//Identifies the client of a request, fails when the request has to be rejected
+func (r *RateLimiter) Identify(req *http.Request, remoteIP string) (Identity, error) {
+	return r.config.identify(req, remoteIP)
+}
+
+//Applies the first rule matching the request, or the limit of the identity,
+//within the scope of the request
+func (r *RateLimiter) Decide(req *http.Request, id Identity) Decision {
+	sl := r.scopeLimiter(req)
+	rule := matchRule(sl.settings.Rules, req)
+	if rule == nil {
+		return Decision{Result: take(sl.storeFor(r.config.limitFor(id, sl.settings)), id.Key)}
+	}
+
+	switch rule.Action {
+	case ACTION_BLOCK:
+		return Decision{Rule: rule, Blocked: true}
+	case ACTION_EXEMPT:
+		return Decision{Rule: rule, Result: store.Result{Allowed: true}}
+	}
+	return Decision{Rule: rule, Result: take(sl.ruleLimiter(rule.Name).store, id.Key)}
+}
+
+//Returns the status of the response rejecting the request
+func (d Decision) Status() int {
+	switch {
+	case d.Rule != nil && d.Rule.Status != 0:
+		return d.Rule.Status
+	case d.Blocked:
+		return http.StatusForbidden
+	}
+	return http.StatusTooManyRequests
+}
+
+func (r *RateLimiter) ExceedsLimitFor(req *http.Request, id Identity) bool {
+	return !r.Decide(req, id).Allowed
+}
+
+//Returns the default faults of the scope of the request, with the delay of the scope
+func (r *RateLimiter) FaultsFor(req *http.Request) *FaultConfig {
+	return r.scopeLimiter(req).settings.Faults
+}
+
+func exceeds(s store.Store, ip string) bool {
+	if _, err := s.Increment(ip); err != nil {
 		fmt.Printf("rate limit exceeded for %s\n", ip)
 		return true
 	}
@@ -33,13 +257,94 @@ func (r *RateLimiter) ExceedsLimit(ip string) bool {
 	return false
 }
 
+func take(s store.Store, key string) store.Result {
+	result := s.Take(key)
+	if !result.Allowed {
+		fmt.Printf("rate limit exceeded for %s\n", key)
+	}
+	return result
+}
+
+//Closes the stores that were not carried over to the next RateLimiter
+func (r *RateLimiter) Release(next *RateLimiter) {
+	r.Lock()
+	defer r.Unlock()
+	next.Lock()
+	defer next.Unlock()
+
+	for scope, sl := range r.scopes {
+		n := next.scopes[scope]
+		if n == nil || n.store != sl.store {
+			sl.store.Close()
+		}
+		for _, rl := range sl.rules {
+			if nrl := n.ruleLimiter(rl.rule.Name); rl.store != nil && (nrl == nil || nrl.store != rl.store) {
+				rl.store.Close()
+			}
+		}
+		for limit, s := range sl.limits {
+			if n == nil || n.limits[limit] != s {
+				s.Close()
+			}
+		}
+	}
+}
+
+//Closes every store, flushing the state of stores that keep any
+func (r *RateLimiter) Close() {
+	r.Lock()
+	defer r.Unlock()
+	for _, sl := range r.scopes {
+		sl.close()
+	}
+}
+
 func (r *RateLimiter) GetStats() Stats {
+	r.Lock()
+	defer r.Unlock()
+
 	s := Stats{}
-	for k, v := range r.store.Stats() {
-		s = append(s, Stat{
-			Ip:        k,
-			Available: v,
-		})
+	for scope, sl := range r.scopes {
+		stores := []store.Store{sl.store}
+		sl.Lock()
+		for _, st := range sl.limits {
+			stores = append(stores, st)
+		}
+		sl.Unlock()
+		for _, st := range stores {
+			for k, v := range st.Stats() {
+				s = append(s, Stat{
+					Ip:        k,
+					Available: v,
+					Scope:     scope,
+				})
+			}
+		}
+		for _, rl := range sl.rules {
+			if rl.store == nil {
+				continue
+			}
+			for k, v := range rl.store.Stats() {
+				s = append(s, Stat{
+					Ip:        k,
+					Available: v,
+					Rule:      rl.rule.Name,
+					Scope:     scope,
+				})
+			}
+		}
 	}
 	return s
 }
+
+//Returns the stats of one service instance, one of its bindings, or one destination
+func (s Stats) ForScope(scope Scope) Stats {
+	filtered := Stats{}
+	for _, stat := range s {
+		if stat.ServiceInstance == scope.ServiceInstance && stat.Destination == scope.Destination &&
+			(scope.Binding == "" || stat.Binding == scope.Binding) {
+			filtered = append(filtered, stat)
+		}
+	}
+	return filtered
+}
@@ -1,7 +1,12 @@
-package main_test
+package main
 
 import (
-	. "github.com/cloudfoundry-samples/ratelimit-service"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/store"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -52,4 +57,105 @@ var _ = Describe("RateLimiter", func() {
 
 	})
 
+	Describe("NewRateLimiterFromConfig", func() {
+		var (
+			cfg *Config
+			req *http.Request
+		)
+
+		BeforeEach(func() {
+			cfg = &Config{
+				Version: CONFIG_VERSION,
+				Limit:   5,
+				Rules:   []Rule{{Name: "reports", Limit: 2, Match: Match{PathPrefix: "/reports"}}},
+			}
+			limiter = NewRateLimiterFromConfig(cfg, nil)
+			req, _ = http.NewRequest("GET", "http://example.com/reports", nil)
+		})
+
+		It("applies the limit of the matching rule", func() {
+			ip := "192.168.1.1"
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeTrue())
+			Expect(limiter.ExceedsLimit(ip)).To(BeFalse())
+		})
+
+		It("preserves buckets of unchanged rules", func() {
+			ip := "192.168.1.1"
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+
+			next := *cfg
+			next.Faults = &FaultConfig{Delay: &DelayFault{Fixed: 10}}
+			reloaded := NewRateLimiterFromConfig(&next, limiter)
+			limiter.Release(reloaded)
+			Expect(reloaded.ExceedsLimitFor(req, Identity{Key: ip})).To(BeTrue())
+		})
+
+		It("resets buckets of changed rules", func() {
+			ip := "192.168.1.1"
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+			Expect(limiter.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+
+			next := *cfg
+			next.Rules = []Rule{{Name: "reports", Limit: 3, Match: Match{PathPrefix: "/reports"}}}
+			reloaded := NewRateLimiterFromConfig(&next, limiter)
+			limiter.Release(reloaded)
+			Expect(reloaded.ExceedsLimitFor(req, Identity{Key: ip})).To(BeFalse())
+		})
+	})
+
+	It("does not leak the stores of replaced limiters on reloads", func() {
+		limiter := NewRateLimiter(10)
+		defer func() { limiter.Close() }()
+		before := runtime.NumGoroutine()
+		for i := 0; i < 50; i++ {
+			reloaded := NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10}, limiter)
+			limiter.Release(reloaded)
+			limiter = reloaded
+		}
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before+2))
+	})
+
+	Describe("scopes", func() {
+		It("evicts idle scopes other than the default one", func() {
+			limiter := NewRateLimiter(10)
+			for _, instance := range []string{"instance-a", "instance-b"} {
+				req, _ := http.NewRequest("GET", "http://app.example.com/", nil)
+				limiter.ExceedsLimitFor(withScope(req, Scope{ServiceInstance: instance}), Identity{Key: "10.0.0.1"})
+			}
+			Expect(limiter.scopes).To(HaveLen(3))
+
+			limiter.scopes[Scope{ServiceInstance: "instance-a"}].usedAt = time.Now().Add(-2 * SCOPE_IDLE_TTL)
+			limiter.prune(time.Now())
+			Expect(limiter.scopes).To(HaveKey(Scope{}))
+			Expect(limiter.scopes).To(HaveKey(Scope{ServiceInstance: "instance-b"}))
+			Expect(limiter.scopes).NotTo(HaveKey(Scope{ServiceInstance: "instance-a"}))
+		})
+
+		It("shares the default budgets once there are too many scopes", func() {
+			limiter := NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10, PerDestination: true}, nil)
+			for i := len(limiter.scopes); i < MAX_SCOPES; i++ {
+				limiter.scopes[Scope{Destination: fmt.Sprintf("app-%d.example.com", i)}] = &scopeLimiter{usedAt: time.Now()}
+			}
+			req, _ := http.NewRequest("GET", "http://other.example.com/", nil)
+			Expect(limiter.scopeLimiter(req) == limiter.scopes[Scope{}]).To(BeTrue())
+			Expect(limiter.scopes).To(HaveLen(MAX_SCOPES))
+		})
+
+		It("evicts idle scopes to make room once there are too many", func() {
+			limiter := NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10, PerDestination: true}, nil)
+			idle := &scopeLimiter{store: store.NewStore(10), usedAt: time.Now().Add(-2 * SCOPE_IDLE_TTL)}
+			for i := len(limiter.scopes); i < MAX_SCOPES; i++ {
+				limiter.scopes[Scope{Destination: fmt.Sprintf("app-%d.example.com", i)}] = idle
+			}
+			limiter.prunedAt = time.Now().Add(-2 * SCOPE_IDLE_TTL)
+			req, _ := http.NewRequest("GET", "http://other.example.com/", nil)
+			Expect(limiter.scopeLimiter(req) == limiter.scopes[Scope{}]).To(BeFalse())
+			Expect(limiter.scopes).To(HaveKey(Scope{Destination: "other.example.com"}))
+			Expect(limiter.scopes).To(HaveLen(2))
+		})
+	})
+
 })
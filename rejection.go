@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_PROBLEM_TYPE = "about:blank"
+
+var defaultRejectionTemplate = template.Must(template.New("rejection").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .RetryAfter}}<p>Please retry in {{.RetryAfter}} seconds.</p>{{end}}
+{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}
+</body>
+</html>
+`))
+
+//RejectionConfig customizes the responses to rejected requests. The response
+//is chosen by the Accept header of the request: application/problem+json for
+//API clients, HTML for browsers and plain text otherwise.
+//
+//	rejection:
+//	  problem_type: https://example.com/problems/rate-limited
+//	  html_template: rejected.html
+type RejectionConfig struct {
+	ProblemType  string `json:"problem_type,omitempty" yaml:"problem_type,omitempty"`
+	HTMLTemplate string `json:"html_template,omitempty" yaml:"html_template,omitempty"`
+
+	template *template.Template
+}
+
+//Rejection holds the variables available to the HTML template, its fields
+//are also the members of the problem+json body
+type Rejection struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Instance   string `json:"instance,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+//Validates the settings and parses the HTML template
+func (c *RejectionConfig) validate() error {
+	if c.HTMLTemplate == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.HTMLTemplate)
+	if err != nil {
+		return err
+	}
+	c.template, err = template.New("rejection").Parse(string(data))
+	if err != nil {
+		return errors.New("invalid html_template: " + err.Error())
+	}
+	return nil
+}
+
+//Builds the response rejecting the request with the status
+func (c *Config) reject(req *http.Request, status int, d Decision) *http.Response {
+	rejection := Rejection{
+		Type:      DEFAULT_PROBLEM_TYPE,
+		Title:     rejectionTitle(status),
+		Status:    status,
+		Instance:  req.URL.Path,
+		RequestID: requestID(req),
+	}
+	if d.Rule != nil {
+		rejection.Rule = d.Rule.Name
+	}
+	if !d.Allowed && d.Limit != 0 {
+		rejection.RetryAfter = seconds(d.RetryAfter)
+		rejection.Detail = "Rate limit of " + strconv.Itoa(d.Limit) + " requests per second exceeded"
+	}
+	if isGRPC(req) {
+		message := rejection.Title
+		if rejection.Detail != "" {
+			message = rejection.Detail
+		}
+		resp := grpcResponse(status, message, d.RetryAfter)
+		c.setRateLimitHeaders(resp.Header, d, time.Now())
+		return resp
+	}
+	tmpl := defaultRejectionTemplate
+	if c.Rejection != nil {
+		if c.Rejection.ProblemType != "" {
+			rejection.Type = c.Rejection.ProblemType
+		}
+		if c.Rejection.template != nil {
+			tmpl = c.Rejection.template
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+	}
+	body := &bytes.Buffer{}
+	switch negotiate(req.Header.Get("Accept")) {
+	case "application/problem+json":
+		resp.Header.Set("Content-Type", "application/problem+json")
+		json.NewEncoder(body).Encode(rejection)
+	case "text/html":
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(body, rejection); err != nil {
+			body.Reset()
+			defaultRejectionTemplate.Execute(body, rejection)
+		}
+	default:
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		body.WriteString(rejection.Title)
+	}
+	resp.Body = ioutil.NopCloser(body)
+	resp.ContentLength = int64(body.Len())
+	c.setRateLimitHeaders(resp.Header, d, time.Now())
+	return resp
+}
+
+func rejectionTitle(status int) string {
+	switch status {
+	case http.StatusTooManyRequests:
+		return "Too many requests"
+	case http.StatusServiceUnavailable:
+		return "Service unavailable"
+	}
+	return http.StatusText(status)
+}
+
+//The request ID assigned by the gorouter, or by another proxy in front of the service
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Vcap-Request-Id"); id != "" {
+		return id
+	}
+	return req.Header.Get("X-Request-Id")
+}
+
+//The rejection formats, in the order picked for wildcards
+var rejectionFormats = []string{"text/plain", "application/problem+json", "text/html"}
+
+//Returns the rejection formats a media range of the Accept header covers
+func rejectionFormatsFor(mediaRange string) []string {
+	switch mediaRange {
+	case "application/problem+json", "application/json":
+		return []string{"application/problem+json"}
+	case "text/html", "application/xhtml+xml":
+		return []string{"text/html"}
+	case "text/plain":
+		return []string{"text/plain"}
+	case "text/*":
+		return []string{"text/plain", "text/html"}
+	case "application/*":
+		return []string{"application/problem+json"}
+	case "*/*":
+		return rejectionFormats
+	}
+	return nil
+}
+
+//How a media range of the Accept header rates a rejection format
+type preference struct {
+	q           float64
+	index       int //Position in the header, earlier ranges win ties
+	specificity int //*/* is 0, type/* is 1, a full media type is 2
+}
+
+//Picks the rejection format the Accept header prefers, by quality and then by
+//order. The most specific range covering a format sets its quality, so q=0
+//excludes a format, e.g. application/json;q=0 with */*.
+func negotiate(accept string) string {
+	prefs := make(map[string]preference)
+	for i, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		pref := preference{q: 1, index: i, specificity: 2 - strings.Count(mediaRange, "*")}
+		if v, ok := params["q"]; ok {
+			if pref.q, err = strconv.ParseFloat(v, 64); err != nil || pref.q < 0 || pref.q > 1 {
+				continue
+			}
+		}
+		for _, format := range rejectionFormatsFor(mediaRange) {
+			if prev, ok := prefs[format]; !ok || pref.specificity > prev.specificity {
+				prefs[format] = pref
+			}
+		}
+	}
+
+	best := ""
+	for _, format := range rejectionFormats {
+		pref, ok := prefs[format]
+		if !ok || pref.q == 0 {
+			continue
+		}
+		if top := prefs[best]; best == "" || pref.q > top.q || pref.q == top.q && pref.index < top.index {
+			best = format
+		}
+	}
+	if best == "" {
+		return "text/plain" //Nothing acceptable, plain text is the least surprising
+	}
+	return best
+}
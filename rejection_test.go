@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rejection", func() {
+	var (
+		cfg      *Config
+		req      *http.Request
+		decision Decision
+	)
+
+	BeforeEach(func() {
+		cfg = &Config{Version: CONFIG_VERSION, Limit: 10, Headers: HEADERS_NONE}
+		req, _ = http.NewRequest("GET", "http://example.com/reports", nil)
+		req.Header.Set("X-Vcap-Request-Id", "req-1")
+		decision = Decision{
+			Rule:   &Rule{Name: "reports", Limit: 2, Status: 503},
+			Result: store.Result{Limit: 2, Reset: time.Second, RetryAfter: 500 * time.Millisecond},
+		}
+	})
+
+	body := func(resp *http.Response) string {
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	It("answers plain text by default", func() {
+		resp := cfg.reject(req, 429, Decision{})
+		Expect(resp.StatusCode).To(Equal(429))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+		Expect(body(resp)).To(Equal("Too many requests"))
+	})
+
+	It("answers problem+json to API clients", func() {
+		req.Header.Set("Accept", "application/json")
+		resp := cfg.reject(req, decision.Status(), decision)
+		Expect(resp.StatusCode).To(Equal(503))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/problem+json"))
+		Expect(resp.Header.Get("Retry-After")).To(Equal("1"))
+
+		var problem Rejection
+		Expect(json.Unmarshal([]byte(body(resp)), &problem)).To(Succeed())
+		Expect(problem).To(Equal(Rejection{
+			Type:       DEFAULT_PROBLEM_TYPE,
+			Title:      "Service unavailable",
+			Status:     503,
+			Detail:     "Rate limit of 2 requests per second exceeded",
+			Instance:   "/reports",
+			Rule:       "reports",
+			RetryAfter: 1,
+			RequestID:  "req-1",
+		}))
+	})
+
+	It("renders the html template for browsers", func() {
+		tempDir, err := ioutil.TempDir("", "rejection")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tempDir)
+		path := filepath.Join(tempDir, "rejected.html")
+		Expect(ioutil.WriteFile(path, []byte(`<p>{{.Rule}} {{.RetryAfter}} {{.RequestID}}</p>`), 0644)).To(Succeed())
+		cfg.Rejection = &RejectionConfig{HTMLTemplate: path}
+		Expect(cfg.Validate()).To(Succeed())
+
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+		resp := cfg.reject(req, decision.Status(), decision)
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/html; charset=utf-8"))
+		Expect(body(resp)).To(Equal("<p>reports 1 req-1</p>"))
+	})
+
+	It("honours the quality and order of the Accept header", func() {
+		Expect(negotiate("application/json;q=0, text/plain")).To(Equal("text/plain"))
+		Expect(negotiate("application/json;q=0, */*")).To(Equal("text/plain"))
+		Expect(negotiate("text/plain;q=0, */*")).To(Equal("application/problem+json"))
+		Expect(negotiate("text/html;q=0.5, application/json;q=0.9")).To(Equal("application/problem+json"))
+		Expect(negotiate("application/json, text/html")).To(Equal("application/problem+json"))
+		Expect(negotiate("text/*;q=0.5, text/html")).To(Equal("text/html"))
+		Expect(negotiate("application/json;q=0")).To(Equal("text/plain"))
+		Expect(negotiate("")).To(Equal("text/plain"))
+
+		req.Header.Set("Accept", "application/json;q=0, text/plain")
+		resp := cfg.reject(req, decision.Status(), decision)
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+	})
+
+	It("rejects blocked requests with 403 unless the rule sets a status", func() {
+		Expect(Decision{Rule: &Rule{Action: ACTION_BLOCK}, Blocked: true}.Status()).To(Equal(403))
+		Expect(Decision{Rule: &Rule{Action: ACTION_BLOCK, Status: 451}, Blocked: true}.Status()).To(Equal(451))
+		Expect(Decision{}.Status()).To(Equal(429))
+	})
+
+	It("validates rule statuses", func() {
+		_, err := ParseConfig([]byte("version: 1\nlimit: 3\nrules:\n  - name: a\n    limit: 1\n    status: 500\n"))
+		Expect(err).To(MatchError(ContainSubstring("status must be 429 or 503")))
+		_, err = ParseConfig([]byte("version: 1\nlimit: 3\nrules:\n  - name: a\n    action: block\n    status: 503\n"))
+		Expect(err).To(MatchError(ContainSubstring("status must be a 4xx")))
+	})
+})
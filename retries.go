@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_BACKOFF     = 50   //Milliseconds before the first retry, doubled for every further retry
+	DEFAULT_RETRY_MAX_BACKOFF = 1000 //Milliseconds
+	DEFAULT_RETRY_BUDGET      = 10   //Percentage of requests that may be retried
+	DEFAULT_MIN_RETRIES       = 10   //Retries per budget window allowed regardless of the budget
+	DEFAULT_RETRY_MAX_BODY    = 1 << 20
+	RETRY_BUDGET_WINDOW       = 10 * time.Second
+)
+
+var (
+	defaultRetryMethods  = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+	defaultRetryStatuses = []int{502, 503, 504}
+
+	retryBudget = NewRetryBudget(RETRY_BUDGET_WINDOW)
+)
+
+//RetryConfig retries idempotent requests on connection errors and failure
+//statuses. Retries are limited by a budget shared by all requests, so they
+//never amplify an outage.
+//
+//	retries:
+//	  attempts: 2
+//	  statuses: [502, 503, 504]
+//	  budget: 10
+type RetryConfig struct {
+	Attempts   int      `json:"attempts" yaml:"attempts"` //Retries after the first attempt
+	Statuses   []int    `json:"statuses,omitempty" yaml:"statuses,omitempty"`
+	Methods    []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Backoff    int      `json:"backoff,omitempty" yaml:"backoff,omitempty"`         //Milliseconds
+	MaxBackoff int      `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty"` //Milliseconds
+	Budget     float64  `json:"budget,omitempty" yaml:"budget,omitempty"`           //Percentage of requests that may be retried
+	MinRetries int      `json:"min_retries,omitempty" yaml:"min_retries,omitempty"` //Per 10 seconds, regardless of the budget
+	MaxBody    int64    `json:"max_body,omitempty" yaml:"max_body,omitempty"`       //Bytes buffered to replay request bodies
+}
+
+func (c *RetryConfig) validate() error {
+	if c.Attempts < 1 {
+		return errors.New("attempts must be at least 1")
+	}
+	if len(c.Statuses) == 0 {
+		c.Statuses = defaultRetryStatuses
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = defaultRetryMethods
+	}
+	if c.Backoff == 0 {
+		c.Backoff = DEFAULT_RETRY_BACKOFF
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DEFAULT_RETRY_MAX_BACKOFF
+	}
+	if c.Budget == 0 {
+		c.Budget = DEFAULT_RETRY_BUDGET
+	}
+	if c.MinRetries == 0 {
+		c.MinRetries = DEFAULT_MIN_RETRIES
+	}
+	if c.MaxBody == 0 {
+		c.MaxBody = DEFAULT_RETRY_MAX_BODY
+	}
+	if c.Backoff < 0 || c.MaxBackoff < c.Backoff || c.MinRetries < 0 || c.MaxBody < 0 {
+		return errors.New("backoff, max_backoff, min_retries and max_body must be positive, max_backoff at least backoff")
+	}
+	if c.Budget < 0 || c.Budget > 100 {
+		return fmt.Errorf("budget must be between 0 and 100, got %g", c.Budget)
+	}
+	for _, method := range c.Methods {
+		if method == "POST" || method == "PATCH" {
+			return fmt.Errorf("%s requests are not idempotent", method)
+		}
+	}
+	return nil
+}
+
+//Returns whether the request may be retried, buffering its body so it can be replayed
+func (c *RetryConfig) replayable(req *http.Request) bool {
+	if !containsFold(c.Methods, req.Method) {
+		return false
+	}
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if req.ContentLength < 0 || req.ContentLength > c.MaxBody {
+		return false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		return false
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true
+}
+
+func (c *RetryConfig) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	for _, status := range c.Statuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the backoff before the retry, doubled for every retry and jittered
+func (c *RetryConfig) backoff(retry int) time.Duration {
+	backoff := c.Backoff << uint(retry-1)
+	if backoff > c.MaxBackoff || backoff <= 0 {
+		backoff = c.MaxBackoff
+	}
+	return time.Duration(float64(backoff)*(0.5+randFloat()/2)) * time.Millisecond
+}
+
+//RetryBudget allows retries for a percentage of the requests of the current window
+type RetryBudget struct {
+	window      time.Duration
+	windowStart time.Time
+	requests    int64
+	retries     int64
+
+	stats RetryStats
+	sync.Mutex
+}
+
+//RetryStats are the totals reported in /stats/retries
+type RetryStats struct {
+	Requests  int64 `json:"requests"`
+	Retries   int64 `json:"retries"`
+	Exhausted int64 `json:"budget_exhausted"` //Retries skipped because the budget was spent
+}
+
+func NewRetryBudget(window time.Duration) *RetryBudget {
+	return &RetryBudget{window: window, windowStart: time.Now()}
+}
+
+func (b *RetryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart, b.requests, b.retries = now, 0, 0
+	}
+}
+
+//Counts a request forwarded upstream
+func (b *RetryBudget) Request(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	b.requests++
+	b.stats.Requests++
+}
+
+//Takes a retry from the budget, returns false when it is spent
+func (b *RetryBudget) Withdraw(c *RetryConfig, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	if b.retries >= int64(c.MinRetries) && float64(b.retries+1) > float64(b.requests)*c.Budget/100 {
+		b.stats.Exhausted++
+		return false
+	}
+	b.retries++
+	b.stats.Retries++
+	return true
+}
+
+func (b *RetryBudget) Stats() RetryStats {
+	b.Lock()
+	defer b.Unlock()
+	return b.stats
+}
+
+func retryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(retryBudget.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
+
+//Discards the response of an attempt that is retried, so its connection can be reused
+func discard(res *http.Response) {
+	if res == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+}
+
+//Returns the retry settings for requests matching the rule, nil when requests are not retried
+func (c *Config) retriesFor(rule *Rule) *RetryConfig {
+	if rule != nil && rule.Retries != nil {
+		return rule.Retries
+	}
+	return c.Retries
+}
+
+//Forwards the request upstream, retrying it while the retry settings, the
+//budget and the circuit breaker of the destination allow. Every attempt is
+//recorded by the breaker.
+func (r *RateLimitedRoundTripper) forward(req *http.Request, cfg *Config, rule *Rule, breaker *Breaker) (*http.Response, error) {
+	transport := cfg.transportFor(rule)
+	if isGRPC(req) { //gRPC requires HTTP/2 to the upstream
+		transport.H2C = true
+	}
+	retries := cfg.retriesFor(rule)
+	retryable := retries != nil && retries.replayable(req)
+	retryBudget.Request(time.Now())
+
+	for retry := 1; ; retry++ {
+		res, err := r.transports.roundTrip(req, transport)
+		if breaker != nil {
+			if failed := cfg.CircuitBreaker.failed(req, res, err); failed || err == nil {
+				breaker.record(cfg.CircuitBreaker, failed, time.Now())
+			} else {
+				breaker.release() //The client went away, which says nothing about the upstream
+			}
+		}
+		if !retryable || retry > retries.Attempts || !retries.shouldRetry(req, res, err) {
+			return res, err
+		}
+		if breaker != nil {
+			if ok, _ := breaker.allow(cfg.CircuitBreaker, time.Now()); !ok {
+				return res, err
+			}
+		}
+		if !retryBudget.Withdraw(retries, time.Now()) {
+			log.Printf("Retry budget exhausted, not retrying request to [%s]", req.URL.Host)
+			if breaker != nil {
+				breaker.release()
+			}
+			return res, err
+		}
+
+		backoff := retries.backoff(retry)
+		log.Printf("Retrying request to [%s] in %s (retry %d of %d): %s", req.URL.Host, backoff, retry, retries.Attempts, outcome(res, err))
+		discard(res)
+		if err = rewind(req, backoff); err != nil {
+			if breaker != nil {
+				breaker.release()
+			}
+			return nil, err
+		}
+	}
+}
+
+//Waits for the backoff and resets the body of the request for the next attempt
+func rewind(req *http.Request, backoff time.Duration) error {
+	select {
+	case <-time.After(backoff):
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func outcome(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return res.Status
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retries", func() {
+	var (
+		cfg     *RetryConfig
+		backend *httptest.Server
+		bodies  []string
+		codes   []int
+	)
+
+	BeforeEach(func() {
+		cfg = &RetryConfig{Attempts: 2, Backoff: 1, MaxBackoff: 2}
+		Expect(cfg.validate()).To(Succeed())
+		retryBudget = NewRetryBudget(RETRY_BUDGET_WINDOW)
+		bodies, codes = nil, []int{503, 502, 200}
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(codes[len(bodies)-1])
+		}))
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	send := func(method string, body string) int {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, Retries: cfg}, nil)
+		req := httptest.NewRequest(method, "http://ratelimiter.example.com/", strings.NewReader(body))
+		req.Header.Set(CF_FORWARDED_URL, backend.URL)
+		w := httptest.NewRecorder()
+		newProxy().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	It("retries idempotent requests on failure statuses, replaying the body", func() {
+		Expect(send("PUT", "payload")).To(Equal(200))
+		Expect(bodies).To(Equal([]string{"payload", "payload", "payload"}))
+		Expect(retryBudget.Stats()).To(Equal(RetryStats{Requests: 1, Retries: 2}))
+	})
+
+	It("gives up after the configured attempts", func() {
+		cfg.Attempts = 1
+		Expect(send("GET", "")).To(Equal(502))
+		Expect(bodies).To(HaveLen(2))
+	})
+
+	It("does not retry other methods", func() {
+		Expect(send("POST", "payload")).To(Equal(503))
+		Expect(bodies).To(HaveLen(1))
+	})
+
+	It("stops retrying when the budget is spent", func() {
+		cfg.MinRetries = 1
+		Expect(send("GET", "")).To(Equal(502))
+		Expect(retryBudget.Stats()).To(Equal(RetryStats{Requests: 1, Retries: 1, Exhausted: 1}))
+	})
+
+	It("allows retries for a percentage of the requests of the window", func() {
+		budget := NewRetryBudget(time.Second)
+		cfg.MinRetries = 1
+		now := time.Now()
+		for i := 0; i < 20; i++ {
+			budget.Request(now)
+		}
+		Expect(budget.Withdraw(cfg, now)).To(BeTrue())
+		Expect(budget.Withdraw(cfg, now)).To(BeTrue())
+		Expect(budget.Withdraw(cfg, now)).To(BeFalse())
+
+		later := now.Add(2 * time.Second)
+		budget.Request(later)
+		Expect(budget.Withdraw(cfg, later)).To(BeTrue())
+	})
+
+	It("does not buffer bodies of unknown or excessive length", func() {
+		req := httptest.NewRequest("PUT", "http://app.example.com/", strings.NewReader("payload"))
+		cfg.MaxBody = 3
+		Expect(cfg.replayable(req)).To(BeFalse())
+		req.ContentLength = -1
+		cfg.MaxBody = 100
+		Expect(cfg.replayable(req)).To(BeFalse())
+		req.ContentLength = 7
+		Expect(cfg.replayable(req)).To(BeTrue())
+		Expect(req.GetBody).NotTo(BeNil())
+	})
+
+	It("backs off exponentially up to the maximum", func() {
+		randFloat = func() float64 { return 1 }
+		defer func() { randFloat = rand.Float64 }()
+		cfg.Backoff, cfg.MaxBackoff = 50, 150
+		Expect(cfg.backoff(1)).To(Equal(50 * time.Millisecond))
+		Expect(cfg.backoff(2)).To(Equal(100 * time.Millisecond))
+		Expect(cfg.backoff(3)).To(Equal(150 * time.Millisecond))
+	})
+
+	It("rejects non idempotent methods", func() {
+		Expect((&RetryConfig{Attempts: 1, Methods: []string{"POST"}}).validate()).NotTo(Succeed())
+		Expect((&RetryConfig{Attempts: 0}).validate()).NotTo(Succeed())
+		Expect((&RetryConfig{Attempts: 1, Budget: 120}).validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/routeservice"
+)
+
+const DEFAULT_SIGNATURE_MAX_AGE = 60 //Seconds, the default route service timeout of the gorouter
+
+//SignatureConfig rejects requests that were not forwarded by the gorouter of
+//the deployment, by verifying X-CF-Proxy-Signature with the route service secret.
+//
+//	route_service_signature:
+//	  secret_env: ROUTE_SERVICE_SECRET
+//	  previous_secret_env: ROUTE_SERVICE_SECRET_PREVIOUS
+//	  max_age: 60
+type SignatureConfig struct {
+	Secret            string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	SecretEnv         string `json:"secret_env,omitempty" yaml:"secret_env,omitempty"`
+	PreviousSecretEnv string `json:"previous_secret_env,omitempty" yaml:"previous_secret_env,omitempty"` //Accepted while the secret is rotated
+	MaxAge            int    `json:"max_age,omitempty" yaml:"max_age,omitempty"`                         //Seconds a signature stays valid
+
+	verifier *routeservice.Verifier
+}
+
+//Validates the settings and derives the keys signatures are decrypted with
+func (c *SignatureConfig) validate() error {
+	if c.MaxAge == 0 {
+		c.MaxAge = DEFAULT_SIGNATURE_MAX_AGE
+	}
+	if c.MaxAge < 0 {
+		return errors.New("max_age must not be negative")
+	}
+
+	secret := c.Secret
+	if c.SecretEnv != "" {
+		secret = os.Getenv(c.SecretEnv)
+	}
+	if secret == "" {
+		return errors.New("a secret is required")
+	}
+	secrets := []string{secret}
+	if c.PreviousSecretEnv != "" {
+		if previous := os.Getenv(c.PreviousSecretEnv); previous != "" {
+			secrets = append(secrets, previous)
+		}
+	}
+
+	verifier, err := routeservice.NewVerifier(time.Duration(c.MaxAge)*time.Second, secrets...)
+	if err != nil {
+		return err
+	}
+	c.verifier = verifier
+	return nil
+}
+
+//Verifies the route service signature of the request when it is configured
+func (c *Config) verifySignature(req *http.Request) error {
+	if c.Signature == nil {
+		return nil
+	}
+	_, err := c.Signature.verifier.Verify(
+		req.Header.Get(routeservice.SIGNATURE_HEADER),
+		req.Header.Get(routeservice.METADATA_HEADER),
+		req.Header.Get(CF_FORWARDED_URL),
+		time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/vipinvkmenon/ratelimit-service/routeservice"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Route service signature", func() {
+	const forwardedURL = "https://app.example.com/"
+
+	var (
+		cfg *Config
+		req *http.Request
+	)
+
+	BeforeEach(func() {
+		os.Setenv("TEST_ROUTE_SERVICE_SECRET", "secret")
+		cfg = &Config{
+			Version:   CONFIG_VERSION,
+			Limit:     10,
+			Signature: &SignatureConfig{SecretEnv: "TEST_ROUTE_SERVICE_SECRET"},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+		req, _ = http.NewRequest("GET", forwardedURL, nil)
+		req.Header.Set(CF_FORWARDED_URL, forwardedURL)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("TEST_ROUTE_SERVICE_SECRET")
+	})
+
+	sign := func(secret string, url string) {
+		signature, metadata, err := routeservice.Sign(secret, routeservice.Signature{ForwardedURL: url, RequestedTime: time.Now()})
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set(routeservice.SIGNATURE_HEADER, signature)
+		req.Header.Set(routeservice.METADATA_HEADER, metadata)
+	}
+
+	It("accepts requests signed by the gorouter", func() {
+		sign("secret", forwardedURL)
+		Expect(cfg.verifySignature(req)).To(Succeed())
+		Expect(cfg.Signature.MaxAge).To(Equal(DEFAULT_SIGNATURE_MAX_AGE))
+	})
+
+	It("rejects unsigned, forged and replayed requests", func() {
+		Expect(cfg.verifySignature(req)).To(Equal(routeservice.ErrMissing))
+		sign("guessed", forwardedURL)
+		Expect(cfg.verifySignature(req)).To(Equal(routeservice.ErrDecrypt))
+		sign("secret", "https://other.example.com/")
+		Expect(cfg.verifySignature(req)).To(Equal(routeservice.ErrURLMismatch))
+	})
+
+	It("skips verification when it is not configured", func() {
+		cfg.Signature = nil
+		Expect(cfg.verifySignature(req)).To(Succeed())
+	})
+
+	It("requires a secret", func() {
+		os.Unsetenv("TEST_ROUTE_SERVICE_SECRET")
+		cfg.Signature = &SignatureConfig{SecretEnv: "TEST_ROUTE_SERVICE_SECRET"}
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("a secret is required")))
+	})
+})
@@ -0,0 +1,13 @@
+package routeservice_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRouteservice(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Routeservice Suite")
+}
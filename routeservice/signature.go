@@ -0,0 +1,151 @@
+//Package routeservice verifies the signature the gorouter adds to requests it
+//forwards to a route service.
+//
+//The gorouter encrypts the forwarded URL and the time of the request with
+//AES-GCM, using a key derived from the route service secret of the deployment,
+//and sends it in X-CF-Proxy-Signature. The nonce travels in X-CF-Proxy-Metadata.
+//The route service returns both headers unchanged with the request it proxies.
+package routeservice
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	SIGNATURE_HEADER = "X-CF-Proxy-Signature"
+	METADATA_HEADER  = "X-CF-Proxy-Metadata"
+
+	keyIterations = 100000
+	keyLength     = 16
+)
+
+var (
+	ErrMissing     = errors.New("missing route service signature")
+	ErrMalformed   = errors.New("malformed route service signature")
+	ErrDecrypt     = errors.New("route service signature not encrypted with a known key")
+	ErrURLMismatch = errors.New("forwarded url does not match the signature")
+	ErrExpired     = errors.New("route service signature expired")
+)
+
+//Signature is the content of X-CF-Proxy-Signature once decrypted
+type Signature struct {
+	ForwardedURL  string    `json:"forwarded_url"`
+	RequestedTime time.Time `json:"requested_time"`
+}
+
+type metadata struct {
+	Nonce []byte `json:"nonce"`
+}
+
+//Verifier decrypts signatures with the current and previous route service
+//secrets, so signatures stay valid while the secret is rotated
+type Verifier struct {
+	MaxAge time.Duration
+	Skew   time.Duration //Tolerated for requested times in the future
+
+	ciphers []cipher.AEAD
+}
+
+func NewVerifier(maxAge time.Duration, secrets ...string) (*Verifier, error) {
+	v := &Verifier{MaxAge: maxAge, Skew: 5 * time.Second}
+	for _, secret := range secrets {
+		aead, err := newCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		v.ciphers = append(v.ciphers, aead)
+	}
+	if len(v.ciphers) == 0 {
+		return nil, errors.New("at least one secret is required")
+	}
+	return v, nil
+}
+
+//Derives the key the same way the gorouter does: PBKDF2 with SHA-256, no salt
+//and 100000 iterations
+func newCipher(secret string) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, secret, nil, keyIterations, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Verifies the signature and metadata headers of a request forwarded to forwardedURL
+func (v *Verifier) Verify(signatureHeader, metadataHeader, forwardedURL string, now time.Time) (*Signature, error) {
+	if signatureHeader == "" || metadataHeader == "" {
+		return nil, ErrMissing
+	}
+	encrypted, err := base64.URLEncoding.DecodeString(signatureHeader)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	metadataJSON, err := base64.URLEncoding.DecodeString(metadataHeader)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var meta metadata
+	if err := json.Unmarshal(metadataJSON, &meta); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if len(meta.Nonce) != v.ciphers[0].NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	var plain []byte
+	for _, aead := range v.ciphers {
+		if plain, err = aead.Open(nil, meta.Nonce, encrypted, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	var signature Signature
+	if err := json.Unmarshal(plain, &signature); err != nil {
+		return nil, ErrMalformed
+	}
+	if signature.ForwardedURL != forwardedURL {
+		return nil, ErrURLMismatch
+	}
+	if now.Sub(signature.RequestedTime) > v.MaxAge || signature.RequestedTime.Sub(now) > v.Skew {
+		return nil, ErrExpired
+	}
+	return &signature, nil
+}
+
+//Builds the signature and metadata headers the gorouter would send
+func Sign(secret string, signature Signature) (string, string, error) {
+	aead, err := newCipher(secret)
+	if err != nil {
+		return "", "", err
+	}
+	plain, err := json.Marshal(signature)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+	metadataJSON, err := json.Marshal(metadata{Nonce: nonce})
+	if err != nil {
+		return "", "", err
+	}
+	return base64.URLEncoding.EncodeToString(aead.Seal(nil, nonce, plain, nil)),
+		base64.URLEncoding.EncodeToString(metadataJSON), nil
+}
@@ -0,0 +1,80 @@
+package routeservice_test
+
+import (
+	"encoding/base64"
+	"time"
+
+	. "github.com/vipinvkmenon/ratelimit-service/routeservice"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signature", func() {
+	const forwardedURL = "https://app.example.com/path?q=1"
+
+	var (
+		verifier *Verifier
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		verifier, err = NewVerifier(time.Minute, "current", "previous")
+		Expect(err).ToNot(HaveOccurred())
+		now = time.Now()
+	})
+
+	sign := func(secret string, url string, requested time.Time) (string, string) {
+		signature, metadata, err := Sign(secret, Signature{ForwardedURL: url, RequestedTime: requested})
+		Expect(err).ToNot(HaveOccurred())
+		return signature, metadata
+	}
+
+	It("verifies signatures of the current and previous secret", func() {
+		signature, metadata := sign("current", forwardedURL, now)
+		s, err := verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.ForwardedURL).To(Equal(forwardedURL))
+
+		signature, metadata = sign("previous", forwardedURL, now)
+		_, err = verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("rejects missing, malformed and forged signatures", func() {
+		_, err := verifier.Verify("", "", forwardedURL, now)
+		Expect(err).To(Equal(ErrMissing))
+
+		signature, metadata := sign("current", forwardedURL, now)
+		_, err = verifier.Verify("not base64!", metadata, forwardedURL, now)
+		Expect(err).To(Equal(ErrMalformed))
+		_, err = verifier.Verify(signature, base64.URLEncoding.EncodeToString([]byte("{}")), forwardedURL, now)
+		Expect(err).To(Equal(ErrMalformed))
+
+		signature, metadata = sign("unknown", forwardedURL, now)
+		_, err = verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).To(Equal(ErrDecrypt))
+	})
+
+	It("rejects signatures of another url", func() {
+		signature, metadata := sign("current", "https://other.example.com/", now)
+		_, err := verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).To(Equal(ErrURLMismatch))
+	})
+
+	It("rejects expired signatures and signatures from the future", func() {
+		signature, metadata := sign("current", forwardedURL, now.Add(-2*time.Minute))
+		_, err := verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).To(Equal(ErrExpired))
+
+		signature, metadata = sign("current", forwardedURL, now.Add(time.Minute))
+		_, err = verifier.Verify(signature, metadata, forwardedURL, now)
+		Expect(err).To(Equal(ErrExpired))
+	})
+
+	It("requires a secret", func() {
+		_, err := NewVerifier(time.Minute)
+		Expect(err).To(HaveOccurred())
+	})
+})
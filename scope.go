@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	scopeContextKey contextKey = iota
+	geoContextKey
+)
+
+//Scope identifies an independent set of budgets. Brokered requests are scoped
+//to their service instance and, when configured, to their binding. Requests
+//through the simple proxy share the empty scope unless destinations are
+//configured, then they are scoped to the host (and path prefix) they are forwarded to.
+type Scope struct {
+	ServiceInstance string `json:"service_instance,omitempty"`
+	Binding         string `json:"binding,omitempty"`
+	Destination     string `json:"destination,omitempty"`
+}
+
+//The limits applied within a scope after resolving inheritance
+type scopeSettings struct {
+	Limit  int
+	Faults *FaultConfig
+	Rules  []Rule
+}
+
+//Returns the scope enclosing the scope: the instance of a binding, otherwise the default scope
+func (s Scope) parent() Scope {
+	if s.Binding != "" {
+		return Scope{ServiceInstance: s.ServiceInstance}
+	}
+	return Scope{}
+}
+
+func withScope(req *http.Request, scope Scope) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), scopeContextKey, scope))
+}
+
+func scopeFrom(req *http.Request) Scope {
+	scope, _ := req.Context().Value(scopeContextKey).(Scope)
+	return scope
+}
+
+//Returns the scope of an outgoing request, deriving the destination from its forwarded URL
+func (c *Config) scopeOf(req *http.Request) Scope {
+	scope := scopeFrom(req)
+	if scope.ServiceInstance == "" {
+		scope.Destination = c.destination(req.URL)
+	}
+	return scope
+}
+
+//Returns the longest configured destination matching the URL. Destinations
+//are keyed by host or by host and path prefix, e.g. myapp.example.com/reports.
+//Falls back to the bare host when per_destination is set.
+func (c *Config) destination(u *url.URL) string {
+	host := strings.ToLower(hostWithoutPort(u.Host))
+	best := ""
+	for key := range c.Destinations {
+		if len(key) > len(best) && destinationMatches(key, host, u.Path) {
+			best = key
+		}
+	}
+	if best == "" && c.PerDestination {
+		return host
+	}
+	return best
+}
+
+//Returns whether the config names the scope, rather than the scope being
+//created for whichever instance, binding or destination a request names
+func (c *Config) configured(scope Scope) bool {
+	switch {
+	case scope.ServiceInstance != "":
+		instance := c.Instances[scope.ServiceInstance]
+		return instance != nil && (scope.Binding == "" || instance.Bindings[scope.Binding] != nil)
+	case scope.Destination != "":
+		return c.Destinations[scope.Destination] != nil
+	}
+	return true
+}
+
+func destinationMatches(key string, host string, path string) bool {
+	keyHost, prefix := key, ""
+	if i := strings.Index(key, "/"); i != -1 {
+		keyHost, prefix = key[:i], key[i:]
+	}
+	return strings.EqualFold(keyHost, host) && strings.HasPrefix(path, prefix)
+}
+
+//Resolves the settings for a scope. The binding is dropped from the returned
+//scope unless the instance limits per binding or configures that binding.
+func (c *Config) resolve(scope Scope) (Scope, scopeSettings) {
+	settings := scopeSettings{Limit: c.Limit, Faults: c.Faults, Rules: c.Rules}
+	if scope.ServiceInstance == "" {
+		destination := c.Destinations[scope.Destination]
+		if scope.Destination == "" || (destination == nil && !c.PerDestination) {
+			return Scope{}, settings
+		}
+		if destination != nil {
+			settings = destination.inherit(settings)
+		}
+		return Scope{Destination: scope.Destination}, settings
+	}
+
+	instance := c.Instances[scope.ServiceInstance]
+	if instance == nil {
+		return Scope{ServiceInstance: scope.ServiceInstance}, settings
+	}
+	settings = instance.inherit(settings)
+
+	binding := instance.Bindings[scope.Binding]
+	if scope.Binding == "" || (binding == nil && !instance.PerBinding) {
+		return Scope{ServiceInstance: scope.ServiceInstance}, settings
+	}
+	if binding != nil {
+		settings = binding.inherit(settings)
+	}
+	return scope, settings
+}
+
+func (ic *InstanceConfig) inherit(parent scopeSettings) scopeSettings {
+	settings := parent
+	if ic.Limit != 0 {
+		settings.Limit = ic.Limit
+	}
+	if ic.Delay != nil {
+		settings.Faults = settings.Faults.withDelay(*ic.Delay)
+	}
+	if len(ic.Rules) > 0 {
+		settings.Rules = ic.Rules
+	}
+	return settings
+}
+
+//Returns a copy of the config with the limit and delay of a scope overridden.
+//The copy shares nothing mutable with the original so it can be swapped in atomically.
+func (c *Config) withOverride(scope Scope, limit int, delay *int) *Config {
+	cfg := *c
+	var target *InstanceConfig
+	switch {
+	case scope.ServiceInstance != "":
+		var instance *InstanceConfig
+		cfg.Instances, instance = overrideEntry(c.Instances, scope.ServiceInstance)
+		target = instance
+		if scope.Binding != "" {
+			instance.Bindings, target = overrideEntry(instance.Bindings, scope.Binding)
+		}
+	case scope.Destination != "":
+		cfg.Destinations, target = overrideEntry(c.Destinations, scope.Destination)
+	default:
+		if limit != 0 {
+			cfg.Limit = limit
+		}
+		if delay != nil {
+			cfg.Faults = c.Faults.withDelay(*delay)
+		}
+		return &cfg
+	}
+
+	if limit != 0 {
+		target.Limit = limit
+	}
+	if delay != nil {
+		target.Delay = delay
+	}
+	return &cfg
+}
+
+//Copies the map and replaces the entry for key with a copy that can be modified
+func overrideEntry(entries map[string]*InstanceConfig, key string) (map[string]*InstanceConfig, *InstanceConfig) {
+	copied := make(map[string]*InstanceConfig)
+	for k, v := range entries {
+		copied[k] = v
+	}
+	entry := &InstanceConfig{}
+	if existing := entries[key]; existing != nil {
+		*entry = *existing
+	}
+	copied[key] = entry
+	return copied, entry
+}
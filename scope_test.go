@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scope", func() {
+	var cfg *Config
+
+	BeforeEach(func() {
+		delay := 7
+		cfg = &Config{
+			Version: CONFIG_VERSION,
+			Limit:   10,
+			Delay:   1,
+			Instances: map[string]*InstanceConfig{
+				"instance-a": {Limit: 5, Delay: &delay},
+				"instance-b": {
+					PerBinding: true,
+					Bindings: map[string]*InstanceConfig{
+						"binding-1": {Limit: 2},
+					},
+				},
+			},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+	})
+
+	Describe("resolve", func() {
+		It("uses the defaults outside brokered mode", func() {
+			scope, settings := cfg.resolve(Scope{})
+			Expect(scope).To(Equal(Scope{}))
+			Expect(settings.Limit).To(Equal(10))
+		})
+
+		It("scopes unknown instances with the defaults", func() {
+			scope, settings := cfg.resolve(Scope{ServiceInstance: "other", Binding: "b"})
+			Expect(scope).To(Equal(Scope{ServiceInstance: "other"}))
+			Expect(settings.Limit).To(Equal(10))
+			Expect(settings.Faults.Delay.Fixed).To(Equal(1))
+		})
+
+		It("applies instance overrides and drops the binding", func() {
+			scope, settings := cfg.resolve(Scope{ServiceInstance: "instance-a", Binding: "b"})
+			Expect(scope).To(Equal(Scope{ServiceInstance: "instance-a"}))
+			Expect(settings.Limit).To(Equal(5))
+			Expect(settings.Faults.Delay.Fixed).To(Equal(7))
+		})
+
+		It("scopes bindings of instances limited per binding", func() {
+			scope, settings := cfg.resolve(Scope{ServiceInstance: "instance-b", Binding: "binding-1"})
+			Expect(scope).To(Equal(Scope{ServiceInstance: "instance-b", Binding: "binding-1"}))
+			Expect(settings.Limit).To(Equal(2))
+
+			scope, settings = cfg.resolve(Scope{ServiceInstance: "instance-b", Binding: "binding-2"})
+			Expect(scope).To(Equal(Scope{ServiceInstance: "instance-b", Binding: "binding-2"}))
+			Expect(settings.Limit).To(Equal(10))
+		})
+	})
+
+	Describe("destinations", func() {
+		BeforeEach(func() {
+			cfg.Destinations = map[string]*InstanceConfig{
+				"myapp.example.com":         {Limit: 4},
+				"myapp.example.com/reports": {Limit: 1},
+			}
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("scopes requests by the longest matching destination", func() {
+			req, _ := http.NewRequest("GET", "https://MyApp.example.com:443/reports/2018", nil)
+			scope, settings := cfg.resolve(cfg.scopeOf(req))
+			Expect(scope).To(Equal(Scope{Destination: "myapp.example.com/reports"}))
+			Expect(settings.Limit).To(Equal(1))
+
+			req, _ = http.NewRequest("GET", "https://myapp.example.com/", nil)
+			scope, settings = cfg.resolve(cfg.scopeOf(req))
+			Expect(scope).To(Equal(Scope{Destination: "myapp.example.com"}))
+			Expect(settings.Limit).To(Equal(4))
+		})
+
+		It("shares the default scope for other hosts unless per_destination is set", func() {
+			req, _ := http.NewRequest("GET", "https://other.example.com/", nil)
+			scope, _ := cfg.resolve(cfg.scopeOf(req))
+			Expect(scope).To(Equal(Scope{}))
+
+			cfg.PerDestination = true
+			scope, settings := cfg.resolve(cfg.scopeOf(req))
+			Expect(scope).To(Equal(Scope{Destination: "other.example.com"}))
+			Expect(settings.Limit).To(Equal(10))
+		})
+
+		It("ignores destinations in brokered mode", func() {
+			req, _ := http.NewRequest("GET", "https://myapp.example.com/", nil)
+			req = withScope(req, Scope{ServiceInstance: "instance-a"})
+			scope, _ := cfg.resolve(cfg.scopeOf(req))
+			Expect(scope).To(Equal(Scope{ServiceInstance: "instance-a"}))
+		})
+
+		It("rejects destinations without a host", func() {
+			cfg.Destinations["/reports"] = &InstanceConfig{Limit: 1}
+			Expect(cfg.Validate()).To(HaveOccurred())
+		})
+	})
+
+	Describe("withOverride", func() {
+		It("overrides a binding without touching the original", func() {
+			updated := cfg.withOverride(Scope{ServiceInstance: "instance-a", Binding: "binding-9"}, 3, nil)
+			Expect(updated.Validate()).To(Succeed())
+
+			_, settings := updated.resolve(Scope{ServiceInstance: "instance-a", Binding: "binding-9"})
+			Expect(settings.Limit).To(Equal(3))
+			Expect(settings.Faults.Delay.Fixed).To(Equal(7))
+			Expect(cfg.Instances["instance-a"].Bindings).To(BeEmpty())
+		})
+
+		It("overrides the defaults", func() {
+			delay := 0
+			updated := cfg.withOverride(Scope{}, 4, &delay)
+			Expect(updated.Limit).To(Equal(4))
+			Expect(updated.Faults.Delay).To(BeNil())
+			Expect(cfg.Faults.Delay.Fixed).To(Equal(1))
+			Expect(cfg.Limit).To(Equal(10))
+		})
+	})
+
+	Describe("RateLimiter", func() {
+		It("keeps independent budgets per service instance", func() {
+			limiter := NewRateLimiterFromConfig(cfg, nil)
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			ip := "192.168.1.1"
+
+			instanceA := withScope(req, Scope{ServiceInstance: "instance-a"})
+			for i := 0; i < 5; i++ {
+				Expect(limiter.ExceedsLimitFor(instanceA, Identity{Key: ip})).To(BeFalse())
+			}
+			Expect(limiter.ExceedsLimitFor(instanceA, Identity{Key: ip})).To(BeTrue())
+			Expect(limiter.ExceedsLimitFor(withScope(req, Scope{ServiceInstance: "instance-c"}), Identity{Key: ip})).To(BeFalse())
+			Expect(limiter.FaultsFor(instanceA).Delay.Fixed).To(Equal(7))
+
+			stats := limiter.GetStats().ForScope(Scope{ServiceInstance: "instance-a"})
+			Expect(stats).To(HaveLen(1))
+			Expect(stats[0].Available).To(Equal(0))
+		})
+
+		It("keeps independent budgets per destination", func() {
+			cfg.PerDestination = true
+			limiter := NewRateLimiterFromConfig(cfg, nil)
+			ip := "192.168.1.1"
+
+			first, _ := http.NewRequest("GET", "http://first.example.com/", nil)
+			second, _ := http.NewRequest("GET", "http://second.example.com/", nil)
+			for i := 0; i < 10; i++ {
+				Expect(limiter.ExceedsLimitFor(first, Identity{Key: ip})).To(BeFalse())
+			}
+			Expect(limiter.ExceedsLimitFor(first, Identity{Key: ip})).To(BeTrue())
+			Expect(limiter.ExceedsLimitFor(second, Identity{Key: ip})).To(BeFalse())
+
+			stats := limiter.GetStats().ForScope(Scope{Destination: "second.example.com"})
+			Expect(stats).To(HaveLen(1))
+			Expect(stats[0].Available).To(Equal(9))
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	DEFAULT_READ_HEADER_TIMEOUT = 10  //Seconds
+	DEFAULT_IDLE_TIMEOUT        = 120 //Seconds
+)
+
+//ServerConfig hardens the HTTP server against slow and greedy clients. Timeouts
+//are in seconds, read and write timeouts are off by default as they would cut
+//long uploads, streams and WebSockets. The server settings are read at startup,
+//except for max_body, which rules can override.
+//
+//	server:
+//	  read_header_timeout: 10
+//	  idle_timeout: 120
+//	  max_header_bytes: 65536
+//	  max_body: 10485760
+//	  max_connections_per_ip: 100
+type ServerConfig struct {
+	ReadHeaderTimeout   int   `json:"read_header_timeout,omitempty" yaml:"read_header_timeout,omitempty"`
+	ReadTimeout         int   `json:"read_timeout,omitempty" yaml:"read_timeout,omitempty"`
+	WriteTimeout        int   `json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`
+	IdleTimeout         int   `json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty"`
+	MaxHeaderBytes      int   `json:"max_header_bytes,omitempty" yaml:"max_header_bytes,omitempty"`             //1 MB by default
+	MaxBody             int64 `json:"max_body,omitempty" yaml:"max_body,omitempty"`                             //Bytes of request bodies, no limit by default
+	MaxConnectionsPerIP int   `json:"max_connections_per_ip,omitempty" yaml:"max_connections_per_ip,omitempty"` //No limit by default
+	H2C                 bool  `json:"h2c,omitempty" yaml:"h2c,omitempty"`                                       //Accepts cleartext HTTP/2, e.g. from gRPC clients
+}
+
+func (c *ServerConfig) validate() error {
+	for _, v := range []int{c.ReadHeaderTimeout, c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.MaxHeaderBytes, c.MaxConnectionsPerIP} {
+		if v < 0 {
+			return errors.New("timeouts and limits must not be negative")
+		}
+	}
+	if c.MaxBody < 0 {
+		return errors.New("max_body must not be negative")
+	}
+	return nil
+}
+
+//Returns the server for the handler, with the timeouts and header limit of the config
+func (c *Config) newServer(addr string, handler http.Handler) *http.Server {
+	s := ServerConfig{}
+	if c.Server != nil {
+		s = *c.Server
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: secondsOr(s.ReadHeaderTimeout, DEFAULT_READ_HEADER_TIMEOUT),
+		ReadTimeout:       secondsOr(s.ReadTimeout, 0),
+		WriteTimeout:      secondsOr(s.WriteTimeout, 0),
+		IdleTimeout:       secondsOr(s.IdleTimeout, DEFAULT_IDLE_TIMEOUT),
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+	}
+	if s.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
+
+//Returns the largest request body allowed for requests matching the rule, 0 when unlimited
+func (c *Config) maxBodyFor(rule *Rule) int64 {
+	if rule != nil && rule.MaxBody != 0 {
+		return rule.MaxBody
+	}
+	if c.Server != nil {
+		return c.Server.MaxBody
+	}
+	return 0
+}
+
+//Returns whether the request body exceeds the limit, and otherwise limits reading it
+func limitBody(req *http.Request, limit int64) bool {
+	if limit == 0 || req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+	if req.ContentLength > limit {
+		return true
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, limit)
+	return false
+}
+
+//Returns the listener limiting the connections per client IP when configured
+func (c *Config) limitListener(l net.Listener) net.Listener {
+	if c.Server == nil || c.Server.MaxConnectionsPerIP == 0 {
+		return l
+	}
+	return &ipLimitListener{Listener: l, max: c.Server.MaxConnectionsPerIP, open: make(map[string]int)}
+}
+
+//ipLimitListener closes connections from IPs that have max connections open already
+type ipLimitListener struct {
+	net.Listener
+	max  int
+	open map[string]int
+	sync.Mutex
+}
+
+func (l *ipLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+		if l.acquire(ip) {
+			return &ipLimitConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		log.Printf("Too many connections from [%s], closing connection", ip)
+		conn.Close()
+	}
+}
+
+func (l *ipLimitListener) acquire(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	return true
+}
+
+func (l *ipLimitListener) release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+type ipLimitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *ipLimitConn) Close() error {
+	defer c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	It("sets a read header and an idle timeout by default", func() {
+		server := (&Config{}).newServer(":8080", nil)
+		Expect(server.ReadHeaderTimeout).To(Equal(10 * time.Second))
+		Expect(server.IdleTimeout).To(Equal(120 * time.Second))
+		Expect(server.ReadTimeout).To(BeZero())
+
+		server = (&Config{Server: &ServerConfig{ReadTimeout: 30, MaxHeaderBytes: 4096}}).newServer(":8080", nil)
+		Expect(server.ReadTimeout).To(Equal(30 * time.Second))
+		Expect(server.MaxHeaderBytes).To(Equal(4096))
+	})
+
+	It("rejects request bodies larger than the limit of their rule with 413", func() {
+		received := 0
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = len(body)
+		}))
+		defer backend.Close()
+		rateLimiter = NewRateLimiterFromConfig(&Config{
+			Version: CONFIG_VERSION,
+			Limit:   100,
+			Server:  &ServerConfig{MaxBody: 10},
+			Rules:   []Rule{{Name: "uploads", Limit: 100, MaxBody: 100, Match: Match{PathPrefix: "/uploads"}}},
+		}, nil)
+		proxy := newProxy()
+		send := func(path string, body io.Reader) int {
+			req := httptest.NewRequest("POST", "http://ratelimiter.example.com/", body)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL+path)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		Expect(send("/", strings.NewReader("small"))).To(Equal(200))
+		Expect(send("/", strings.NewReader(strings.Repeat("x", 11)))).To(Equal(413))
+		Expect(send("/uploads", strings.NewReader(strings.Repeat("x", 50)))).To(Equal(200))
+		Expect(received).To(Equal(50))
+		Expect(send("/", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 11))))).To(Equal(413)) //Of unknown length
+	})
+
+	It("closes connections from IPs with too many open at accept time", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		listener := (&Config{Server: &ServerConfig{MaxConnectionsPerIP: 1}}).limitListener(l)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 2)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+
+		first, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer first.Close()
+		conn := <-accepted
+
+		second, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		second.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = second.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		conn.Close()
+		third, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer third.Close()
+		Eventually(accepted).Should(Receive())
+	})
+})
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+const (
+	CLIENT_AUTH_NONE    = "none"
+	CLIENT_AUTH_REQUEST = "request" //Verify client certificates when presented
+	CLIENT_AUTH_REQUIRE = "require"
+
+	CLIENT_KEY_SUBJECT     = "subject"
+	CLIENT_KEY_FINGERPRINT = "fingerprint"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	CLIENT_AUTH_NONE:    tls.NoClientCert,
+	CLIENT_AUTH_REQUEST: tls.VerifyClientCertIfGiven,
+	CLIENT_AUTH_REQUIRE: tls.RequireAndVerifyClientCert,
+}
+
+//ServerTLS serves HTTPS, for deployments outside the CF router, optionally
+//verifying client certificates and limiting clients by them. The certificate
+//and client CAs are reloaded when their files change, the ports are read at
+//startup.
+//
+//	tls:
+//	  cert_file: /etc/ratelimiter/cert.pem
+//	  key_file: /etc/ratelimiter/key.pem
+//	  client_ca_file: /etc/ratelimiter/clients.pem
+//	  client_auth: require
+//	  client_key: fingerprint
+type ServerTLS struct {
+	Port         string `json:"port,omitempty" yaml:"port,omitempty"` //Serves HTTPS on PORT when unset, else HTTP on PORT and HTTPS on this port
+	CertFile     string `json:"cert_file" yaml:"cert_file"`
+	KeyFile      string `json:"key_file" yaml:"key_file"`
+	ClientCAFile string `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty"`
+	ClientAuth   string `json:"client_auth,omitempty" yaml:"client_auth,omitempty"` //none (default), request or require
+	ClientKey    string `json:"client_key,omitempty" yaml:"client_key,omitempty"`   //Limits clients by the subject or fingerprint of their certificate
+	MinVersion   string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+	DisableHTTP2 bool   `json:"disable_http2,omitempty" yaml:"disable_http2,omitempty"`
+
+	config *tls.Config
+}
+
+//Validates the settings and loads the certificate and the client CAs
+func (t *ServerTLS) validate() error {
+	if t.ClientAuth == "" {
+		t.ClientAuth = CLIENT_AUTH_NONE
+	}
+	clientAuth, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return fmt.Errorf("client_auth must be %q, %q or %q", CLIENT_AUTH_NONE, CLIENT_AUTH_REQUEST, CLIENT_AUTH_REQUIRE)
+	}
+	if t.ClientKey != "" && t.ClientKey != CLIENT_KEY_SUBJECT && t.ClientKey != CLIENT_KEY_FINGERPRINT {
+		return fmt.Errorf("client_key must be %q or %q", CLIENT_KEY_SUBJECT, CLIENT_KEY_FINGERPRINT)
+	}
+	if clientAuth != tls.NoClientCert && t.ClientCAFile == "" {
+		return errors.New("client_auth requires a client_ca_file")
+	}
+	if t.ClientKey != "" && clientAuth == tls.NoClientCert {
+		return errors.New("client_key requires client_auth request or require")
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errors.New("cert_file and key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %s", err)
+	}
+	t.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.DisableHTTP2 {
+		t.config.NextProtos = []string{"http/1.1"}
+	}
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("min_version must be 1.0, 1.1, 1.2 or 1.3, got %q", t.MinVersion)
+		}
+		t.config.MinVersion = version
+	}
+	if t.ClientCAFile != "" {
+		ca, err := readPEM(t.ClientCAFile, "")
+		if err != nil {
+			return err
+		}
+		t.config.ClientCAs = x509.NewCertPool()
+		if !t.config.ClientCAs.AppendCertsFromPEM(ca) {
+			return errors.New("no certificates found in the client CA bundle")
+		}
+	}
+	return nil
+}
+
+func (t *ServerTLS) files() []string {
+	files := []string{t.CertFile, t.KeyFile}
+	if t.ClientCAFile != "" {
+		files = append(files, t.ClientCAFile)
+	}
+	return files
+}
+
+//Returns the listener serving TLS with the settings of the current config,
+//falling back to those it was created with when TLS was removed since
+func (t *ServerTLS) listener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		NextProtos: t.config.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if current := currentRateLimiter().Config().TLS; current != nil {
+				return current.config, nil
+			}
+			return t.config, nil
+		},
+	})
+}
+
+//Returns the rate limit key of the verified client certificate of the request, empty without one
+func (t *ServerTLS) clientKey(req *http.Request) string {
+	if t == nil || t.ClientKey == "" || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if t.ClientKey == CLIENT_KEY_FINGERPRINT {
+		sum := sha256.Sum256(cert.Raw)
+		return "cert:" + hex.EncodeToString(sum[:])
+	}
+	return "cert:" + cert.Subject.String()
+}
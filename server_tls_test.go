@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server TLS", func() {
+	var (
+		tempDir    string
+		serverTLS  *ServerTLS
+		clientCert tls.Certificate
+		server     *http.Server
+	)
+
+	write := func(name string, data []byte) string {
+		file := filepath.Join(tempDir, name)
+		Expect(ioutil.WriteFile(file, data, 0600)).To(Succeed())
+		return file
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "server-tls")
+		Expect(err).ToNot(HaveOccurred())
+		cert, key := selfSigned("ratelimiter.example.com")
+		clientPEM, clientKeyPEM := selfSigned("billing")
+		clientCert, err = tls.X509KeyPair(clientPEM, clientKeyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		serverTLS = &ServerTLS{
+			CertFile:     write("cert.pem", cert),
+			KeyFile:      write("key.pem", key),
+			ClientCAFile: write("clients.pem", clientPEM),
+			ClientAuth:   CLIENT_AUTH_REQUIRE,
+			ClientKey:    CLIENT_KEY_SUBJECT,
+		}
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+		os.RemoveAll(tempDir)
+	})
+
+	//Serves the client key and protocol of requests over TLS, returns the URL
+	serve := func() string {
+		cfg := &Config{Version: CONFIG_VERSION, Limit: 10, TLS: serverTLS}
+		Expect(cfg.Validate()).To(Succeed())
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		server = cfg.newServer(l.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto + " " + serverTLS.clientKey(r)))
+		}))
+		go server.Serve(serverTLS.listener(l))
+		return "https://" + l.Addr().String()
+	}
+
+	get := func(url string, certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	It("serves HTTP/2 and limits clients by the subject of their certificate", func() {
+		url := serve()
+		body, err := get(url, clientCert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal("HTTP/2.0 cert:CN=billing"))
+
+		_, err = get(url)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("limits clients by the fingerprint of their certificate", func() {
+		serverTLS.ClientKey = CLIENT_KEY_FINGERPRINT
+		serverTLS.DisableHTTP2 = true
+		body, err := get(serve(), clientCert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(MatchRegexp(`^HTTP/1\.1 cert:[0-9a-f]{64}$`))
+	})
+
+	It("identifies clients by their certificate before their IP", func() {
+		req, _ := http.NewRequest("GET", "https://ratelimiter.example.com/", nil)
+		cfg := &Config{TLS: serverTLS}
+		Expect(cfg.TLS.validate()).To(Succeed())
+		identity, err := cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(identity.Key).To(Equal("10.0.0.1"))
+
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{clientCert.Leaf}}}
+		identity, err = cfg.identify(req, "10.0.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(identity.Key).To(Equal("cert:CN=billing"))
+	})
+
+	It("validates the settings", func() {
+		Expect((&ServerTLS{}).validate()).To(MatchError(ContainSubstring("cert_file and key_file")))
+		Expect((&ServerTLS{CertFile: serverTLS.CertFile, KeyFile: serverTLS.KeyFile, ClientAuth: "always"}).validate()).To(MatchError(ContainSubstring("client_auth")))
+		Expect((&ServerTLS{CertFile: serverTLS.CertFile, KeyFile: serverTLS.KeyFile, ClientAuth: CLIENT_AUTH_REQUIRE}).validate()).To(MatchError(ContainSubstring("client_ca_file")))
+		Expect((&ServerTLS{CertFile: serverTLS.CertFile, KeyFile: serverTLS.KeyFile, ClientKey: CLIENT_KEY_SUBJECT}).validate()).To(MatchError(ContainSubstring("client_key")))
+		Expect((&ServerTLS{CertFile: serverTLS.CertFile, KeyFile: serverTLS.CertFile}).validate()).To(MatchError(ContainSubstring("invalid certificate")))
+	})
+})
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_DRAIN_TIMEOUT = 8 //Seconds, CF kills the process 10 seconds after SIGTERM
+
+var draining int32
+
+//ShutdownConfig controls how the server drains on SIGTERM: it reports
+//not-ready on /health, waits drain_delay for load balancers to notice, stops
+//accepting connections and waits up to drain_timeout for in-flight and queued
+//requests and upgraded connections, then closes the stores and logs the final
+//stats. Both are in seconds and read at startup, their sum must stay below
+//the time the platform waits before killing the process.
+//
+//	shutdown:
+//	  drain_delay: 2
+//	  drain_timeout: 6
+type ShutdownConfig struct {
+	DrainDelay   int `json:"drain_delay,omitempty" yaml:"drain_delay,omitempty"`     //No delay by default
+	DrainTimeout int `json:"drain_timeout,omitempty" yaml:"drain_timeout,omitempty"` //8 seconds by default
+}
+
+func (c *ShutdownConfig) validate() error {
+	if c.DrainDelay < 0 || c.DrainTimeout < 0 {
+		return errors.New("drain_delay and drain_timeout must not be negative")
+	}
+	return nil
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+//Reports whether the instance accepts requests, 503 while draining
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+//Drains the server on SIGTERM or SIGINT, the returned channel is closed once done
+func (c *Config) shutdownOnSignal(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, draining", sig)
+		c.drain(server)
+		close(done)
+	}()
+	return done
+}
+
+//Drains the server and closes the stores of the current config
+func (c *Config) drain(server *http.Server) {
+	s := ShutdownConfig{}
+	if c.Shutdown != nil {
+		s = *c.Shutdown
+	}
+	atomic.StoreInt32(&draining, 1)
+	time.Sleep(secondsOr(s.DrainDelay, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), secondsOr(s.DrainTimeout, DEFAULT_DRAIN_TIMEOUT))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Drain timed out, closing remaining connections: %s", err)
+		server.Close()
+	}
+	//Upgraded connections were hijacked from the server, which does not wait for them
+	for upgrades.Stats().Open > 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if open := upgrades.Stats().Open; open > 0 {
+		log.Printf("Closing with %d upgraded connections open", open)
+	}
+
+	currentRateLimiter().Close()
+	logStats()
+	log.Printf("Drained")
+}
+
+//Logs the final stats, which are otherwise lost with the process
+func logStats() {
+	for _, s := range []struct {
+		name  string
+		stats interface{}
+	}{
+		{"retries", retryBudget.Stats()},
+		{"load-shedding", loadShedder.Stats()},
+		{"queue", fairQueue.Stats()},
+		{"cache", responseCache.Stats()},
+		{"coalescing", coalescer.Stats()},
+		{"connections", upgrades.Stats()},
+	} {
+		if data, err := json.Marshal(s.stats); err == nil {
+			log.Printf("Final %s stats: %s", s.name, data)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	var (
+		release chan struct{}
+		started chan struct{}
+		server  *http.Server
+		addr    string
+	)
+
+	BeforeEach(func() {
+		released, starts := make(chan struct{}), make(chan struct{}, 1)
+		release, started = released, starts
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", healthHandler)
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			starts <- struct{}{}
+			<-released
+			w.Write([]byte("done"))
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		addr = "http://" + l.Addr().String()
+		server = (&Config{}).newServer(l.Addr().String(), mux)
+		go server.Serve(l)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		atomic.StoreInt32(&draining, 0)
+	})
+
+	get := func(path string) (int, string, error) {
+		resp, err := http.Get(addr + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+
+	It("reports not-ready while draining and waits for in-flight requests", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10}, nil)
+		code, body, err := get("/health")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(code).To(Equal(200))
+
+		responses := make(chan string, 1)
+		go func() {
+			_, body, _ := get("/slow")
+			responses <- body
+		}()
+		<-started
+
+		drained := make(chan struct{})
+		cfg := &Config{Shutdown: &ShutdownConfig{DrainDelay: 1, DrainTimeout: 5}}
+		go func() {
+			cfg.drain(server)
+			close(drained)
+		}()
+		Eventually(isDraining).Should(BeTrue())
+		code, body, err = get("/health") //Still accepted during the drain delay
+		Expect(err).ToNot(HaveOccurred())
+		Expect(code).To(Equal(503))
+		Expect(body).To(ContainSubstring("draining"))
+
+		Eventually(func() error { _, _, err := get("/health"); return err }, 3*time.Second).Should(HaveOccurred())
+		Consistently(drained).ShouldNot(BeClosed())
+		close(release)
+		Eventually(responses).Should(Receive(Equal("done")))
+		Eventually(drained).Should(BeClosed())
+	})
+
+	It("closes the remaining connections after the drain timeout", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10}, nil)
+		defer close(release)
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := get("/slow")
+			errs <- err
+		}()
+		<-started
+
+		start := time.Now()
+		(&Config{Shutdown: &ShutdownConfig{DrainTimeout: 1}}).drain(server)
+		Expect(time.Since(start)).To(BeNumerically("~", time.Second, 500*time.Millisecond))
+		Eventually(errs).Should(Receive(HaveOccurred()))
+	})
+
+	It("validates the settings", func() {
+		Expect((&ShutdownConfig{DrainTimeout: -1}).validate()).To(MatchError(ContainSubstring("negative")))
+		Expect((&ShutdownConfig{DrainDelay: 2, DrainTimeout: 6}).validate()).To(Succeed())
+	})
+})
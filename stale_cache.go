@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CACHE_MAX_BYTES = 64 << 20
+	DEFAULT_CACHE_MAX_ENTRY = 1 << 20
+	DEFAULT_MAX_STALE       = 3600 //Seconds
+
+	WARNING_STALE               = `110 - "Response is Stale"`
+	WARNING_REVALIDATION_FAILED = `111 - "Revalidation Failed"`
+)
+
+var responseCache = NewResponseCache()
+
+//StaleCacheConfig keeps cacheable responses to GET requests, and serves them
+//stale instead of rejecting a request that exceeded its limit, was shed or
+//queued out, or whose upstream failed. Responses are cacheable when their
+//Cache-Control allows a shared cache to store them.
+//
+//	stale_cache:
+//	  max_bytes: 67108864
+//	  max_entry: 1048576
+//	  max_stale: 3600
+type StaleCacheConfig struct {
+	MaxBytes int64 `json:"max_bytes,omitempty" yaml:"max_bytes,omitempty"` //Of all cached responses
+	MaxEntry int64 `json:"max_entry,omitempty" yaml:"max_entry,omitempty"` //Bytes of the largest response cached
+	MaxStale int   `json:"max_stale,omitempty" yaml:"max_stale,omitempty"` //Seconds past their freshness responses are served, unless stale-if-error says otherwise
+}
+
+func (c *StaleCacheConfig) validate() error {
+	if c.MaxBytes == 0 {
+		c.MaxBytes = DEFAULT_CACHE_MAX_BYTES
+	}
+	if c.MaxEntry == 0 {
+		c.MaxEntry = DEFAULT_CACHE_MAX_ENTRY
+	}
+	if c.MaxStale == 0 {
+		c.MaxStale = DEFAULT_MAX_STALE
+	}
+	if c.MaxBytes < 0 || c.MaxEntry < 0 || c.MaxStale < 0 {
+		return errors.New("max_bytes, max_entry and max_stale must not be negative")
+	}
+	if c.MaxEntry > c.MaxBytes {
+		return errors.New("max_entry must not exceed max_bytes")
+	}
+	return nil
+}
+
+//Parses a Cache-Control header into its directives
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = arg
+			}
+		}
+	}
+	return directives
+}
+
+//Returns the lifetime of a response from s-maxage, max-age or Expires, and whether it has one
+func freshness(res *http.Response, cc map[string]string) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if arg, ok := cc[directive]; ok {
+			if seconds, err := strconv.Atoi(arg); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+	if expires, err := http.ParseTime(res.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(res.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+//Returns whether a shared cache may store the response to the request
+func cacheable(req *http.Request, res *http.Response) bool {
+	if req.Method != "GET" || res.StatusCode != 200 || res.Header.Get("Set-Cookie") != "" || hasSession(req) {
+		return false
+	}
+	if _, ok := cacheControl(req.Header)["no-store"]; ok {
+		return false
+	}
+	for _, name := range res.Header["Vary"] {
+		if strings.TrimSpace(name) == "*" {
+			return false
+		}
+	}
+	cc := cacheControl(res.Header)
+	for _, directive := range []string{"no-store", "private", "no-cache", "must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return false
+		}
+	}
+	_, ok := freshness(res, cc)
+	return ok
+}
+
+//Returns the cache key of the request: its URL and the values of the headers the response varies by
+func cacheKey(req *http.Request, vary []string) string {
+	key := req.URL.String()
+	for _, name := range vary {
+		key += "\n" + name + ":" + strings.Join(req.Header[http.CanonicalHeaderKey(name)], ",")
+	}
+	return key
+}
+
+func varyHeaders(h http.Header) []string {
+	var vary []string
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, strings.ToLower(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+type cachedResponse struct {
+	url        string
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+	age        time.Duration //Of the response when it was stored
+	staleUntil time.Time
+}
+
+func (e *cachedResponse) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+//ResponseCache holds cached responses up to a size, evicting the least recently used
+type ResponseCache struct {
+	entries map[string]*list.Element
+	vary    map[string]*variants
+	lru     *list.List
+	bytes   int64
+	stats   CacheStats
+	sync.Mutex
+}
+
+//variants are the cached responses of a URL, keyed by the headers they vary by
+type variants struct {
+	vary    []string
+	entries int
+}
+
+//CacheStats are reported in /stats/cache
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Stored  int64 `json:"stored"`
+	Served  int64 `json:"served_stale"`
+	Misses  int64 `json:"misses"` //Of requests that found no response to serve stale
+	Evicted int64 `json:"evicted"`
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{entries: make(map[string]*list.Element), vary: make(map[string]*variants), lru: list.New()}
+}
+
+//Stores the response, evicting the least recently used responses to make room
+func (c *ResponseCache) Store(cfg *StaleCacheConfig, req *http.Request, res *http.Response, body []byte, now time.Time) {
+	cc := cacheControl(res.Header)
+	lifetime, _ := freshness(res, cc)
+	maxStale := time.Duration(cfg.MaxStale) * time.Second
+	if arg, ok := cc["stale-if-error"]; ok {
+		if seconds, err := strconv.Atoi(arg); err == nil && seconds >= 0 {
+			maxStale = time.Duration(seconds) * time.Second
+		}
+	}
+	age, _ := strconv.Atoi(res.Header.Get("Age"))
+	vary := varyHeaders(res.Header)
+	entry := &cachedResponse{
+		url:        req.URL.String(),
+		key:        cacheKey(req, vary),
+		status:     res.StatusCode,
+		header:     res.Header.Clone(),
+		body:       body,
+		storedAt:   now,
+		age:        time.Duration(age) * time.Second,
+		staleUntil: now.Add(lifetime - time.Duration(age)*time.Second + maxStale),
+	}
+	size := entry.size()
+	if size > cfg.MaxEntry {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[entry.key]; ok {
+		c.evict(e)
+	}
+	v, ok := c.vary[entry.url]
+	if !ok || !equalStrings(v.vary, vary) {
+		c.evictURL(entry.url)
+		v = &variants{vary: vary}
+		c.vary[entry.url] = v
+	}
+	v.entries++
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += size
+	c.stats.Stored++
+	for c.bytes > cfg.MaxBytes {
+		c.evict(c.lru.Back())
+		c.stats.Evicted++
+	}
+}
+
+func (c *ResponseCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+	if v := c.vary[entry.url]; v != nil {
+		if v.entries--; v.entries == 0 {
+			delete(c.vary, entry.url)
+		}
+	}
+}
+
+//Evicts the responses of the URL, when it changed the headers it varies by
+func (c *ResponseCache) evictURL(url string) {
+	for e := c.lru.Front(); e != nil && c.vary[url] != nil; {
+		next := e.Next()
+		if e.Value.(*cachedResponse).url == url {
+			c.evict(e)
+		}
+		e = next
+	}
+	delete(c.vary, url)
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the cached response to the request marked with the warning, nil when
+//there is none or it is too stale
+func (c *ResponseCache) Lookup(req *http.Request, warning string, now time.Time) *http.Response {
+	c.Lock()
+	defer c.Unlock()
+	var entry *cachedResponse
+	if v, ok := c.vary[req.URL.String()]; ok {
+		if e, ok := c.entries[cacheKey(req, v.vary)]; ok {
+			entry = e.Value.(*cachedResponse)
+			if now.After(entry.staleUntil) {
+				c.evict(e)
+				entry = nil
+			} else {
+				c.lru.MoveToFront(e)
+			}
+		}
+	}
+	if entry == nil {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Served++
+
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int((entry.age+now.Sub(entry.storedAt))/time.Second)))
+	header.Add("Warning", warning)
+	return &http.Response{
+		StatusCode:    entry.status,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+	}
+}
+
+func (c *ResponseCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Entries, stats.Bytes = len(c.entries), c.bytes
+	return stats
+}
+
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(responseCache.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
+
+//Returns the cached response to the request when the stale cache is enabled, nil
+//otherwise. Requests with credentials are not served the responses of others.
+func (c *Config) stale(req *http.Request, warning string) *http.Response {
+	if c.StaleCache == nil || req.Method != "GET" || isUpgrade(req) || hasSession(req) || c.hasCredentials(req) {
+		return nil
+	}
+	res := responseCache.Lookup(req, warning, time.Now())
+	if res != nil {
+		log.Printf("Serving stale response to [%s]", req.URL)
+	}
+	return res
+}
+
+//Caches a cacheable response to a request without credentials once its body was read completely
+func (c *Config) cache(req *http.Request, res *http.Response) {
+	if c.StaleCache == nil || !cacheable(req, res) || c.hasCredentials(req) || res.ContentLength > c.StaleCache.MaxEntry {
+		return
+	}
+	cfg := c.StaleCache
+	snapshot := &http.Response{StatusCode: res.StatusCode, Header: res.Header.Clone()} //Without the headers added later
+	res.Body = &cachingBody{ReadCloser: res.Body, limit: cfg.MaxEntry, done: func(body []byte) {
+		responseCache.Store(cfg, req, snapshot, body, time.Now())
+	}}
+}
+
+//Copies the body read up to a limit, and hands it over once it was read completely
+type cachingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	done  func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done != nil {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.done = nil
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stale cache", func() {
+	var (
+		cfg *StaleCacheConfig
+		now time.Time
+	)
+
+	BeforeEach(func() {
+		cfg = &StaleCacheConfig{MaxBytes: 1000, MaxEntry: 500, MaxStale: 60}
+		Expect(cfg.validate()).To(Succeed())
+		responseCache = NewResponseCache()
+		now = time.Now()
+	})
+
+	get := func(url string) *http.Request {
+		return httptest.NewRequest("GET", url, nil)
+	}
+	response := func(cacheControl string) *http.Response {
+		return &http.Response{StatusCode: 200, Header: http.Header{"Cache-Control": {cacheControl}}}
+	}
+
+	It("only caches responses a shared cache may store", func() {
+		Expect(cacheable(get("http://app.example.com/"), response("max-age=10"))).To(BeTrue())
+		Expect(cacheable(get("http://app.example.com/"), response("public"))).To(BeFalse())
+		Expect(cacheable(get("http://app.example.com/"), response("private, max-age=10"))).To(BeFalse())
+		Expect(cacheable(get("http://app.example.com/"), response("no-store"))).To(BeFalse())
+		Expect(cacheable(httptest.NewRequest("HEAD", "http://app.example.com/", nil), response("max-age=10"))).To(BeFalse())
+
+		authorized := get("http://app.example.com/")
+		authorized.Header.Set("Authorization", "Bearer token")
+		Expect(cacheable(authorized, response("max-age=10"))).To(BeFalse())
+		Expect(cacheable(authorized, response("public, max-age=10"))).To(BeFalse())
+		withCookie := get("http://app.example.com/")
+		withCookie.Header.Set("Cookie", "session=alice")
+		Expect(cacheable(withCookie, response("public, max-age=10"))).To(BeFalse())
+	})
+
+	It("does not serve cached responses to requests with cookies or Authorization", func() {
+		c := &Config{StaleCache: cfg}
+		res := response("max-age=10")
+		res.Body = ioutil.NopCloser(strings.NewReader("shared"))
+		c.cache(get("http://app.example.com/"), res)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		Expect(c.stale(get("http://app.example.com/"), WARNING_STALE)).ToNot(BeNil())
+
+		withCookie := get("http://app.example.com/")
+		withCookie.Header.Set("Cookie", "session=alice")
+		Expect(c.stale(withCookie, WARNING_STALE)).To(BeNil())
+		authorized := get("http://app.example.com/")
+		authorized.Header.Set("Authorization", "Bearer token")
+		Expect(c.stale(authorized, WARNING_STALE)).To(BeNil())
+	})
+
+	It("serves responses stale with their age and a warning until max_stale", func() {
+		res := response("max-age=10")
+		res.Header.Set("Age", "2")
+		responseCache.Store(cfg, get("http://app.example.com/page"), res, []byte("page"), now)
+
+		stale := responseCache.Lookup(get("http://app.example.com/page"), WARNING_STALE, now.Add(30*time.Second))
+		Expect(stale.StatusCode).To(Equal(200))
+		Expect(stale.Header.Get("Age")).To(Equal("32"))
+		Expect(stale.Header.Get("Warning")).To(Equal(WARNING_STALE))
+		body, _ := ioutil.ReadAll(stale.Body)
+		Expect(string(body)).To(Equal("page"))
+
+		Expect(responseCache.Lookup(get("http://app.example.com/page"), WARNING_STALE, now.Add(69*time.Second))).To(BeNil())
+		Expect(responseCache.Stats()).To(Equal(CacheStats{Stored: 1, Served: 1, Misses: 1}))
+	})
+
+	It("honours stale-if-error", func() {
+		responseCache.Store(cfg, get("http://app.example.com/"), response("max-age=10, stale-if-error=5"), nil, now)
+		Expect(responseCache.Lookup(get("http://app.example.com/"), WARNING_STALE, now.Add(14*time.Second))).NotTo(BeNil())
+		Expect(responseCache.Lookup(get("http://app.example.com/"), WARNING_STALE, now.Add(16*time.Second))).To(BeNil())
+	})
+
+	It("keys responses by the headers they vary by", func() {
+		res := response("max-age=10")
+		res.Header.Set("Vary", "Accept-Language")
+		english := get("http://app.example.com/")
+		english.Header.Set("Accept-Language", "en")
+		responseCache.Store(cfg, english, res, []byte("hello"), now)
+
+		german := get("http://app.example.com/")
+		german.Header.Set("Accept-Language", "de")
+		Expect(responseCache.Lookup(german, WARNING_STALE, now)).To(BeNil())
+		Expect(responseCache.Lookup(english, WARNING_STALE, now)).NotTo(BeNil())
+	})
+
+	It("evicts the least recently used responses beyond max_bytes", func() {
+		body := []byte(strings.Repeat("x", 400))
+		for _, path := range []string{"/a", "/b", "/c"} {
+			responseCache.Store(cfg, get("http://app.example.com"+path), response("max-age=10"), body, now)
+			if path == "/b" {
+				Expect(responseCache.Lookup(get("http://app.example.com/a"), WARNING_STALE, now)).NotTo(BeNil())
+			}
+		}
+		Expect(responseCache.Lookup(get("http://app.example.com/b"), WARNING_STALE, now)).To(BeNil())
+		Expect(responseCache.Lookup(get("http://app.example.com/a"), WARNING_STALE, now)).NotTo(BeNil())
+		stats := responseCache.Stats()
+		Expect(stats.Entries).To(Equal(2))
+		Expect(stats.Bytes).To(BeNumerically("<=", 1000))
+		Expect(stats.Evicted).To(Equal(int64(1)))
+
+		responseCache.Store(cfg, get("http://app.example.com/large"), response("max-age=10"), []byte(strings.Repeat("x", 600)), now)
+		Expect(responseCache.Stats().Entries).To(Equal(2))
+	})
+
+	It("serves the cached response instead of rejecting or failing the request", func() {
+		status := 200
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(status)
+			w.Write([]byte("fresh"))
+		}))
+		defer backend.Close()
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 1, StaleCache: cfg}, nil)
+		proxy := newProxy()
+		send := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL+"/page")
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			return w
+		}
+
+		Expect(send().Header().Get("Warning")).To(BeEmpty())
+		w := send()
+		Expect(w.Code).To(Equal(200))
+		Expect(w.Header().Get("Warning")).To(Equal(WARNING_STALE))
+		Expect(w.Body.String()).To(Equal("fresh"))
+
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, StaleCache: cfg}, nil)
+		status = 502
+		w = send()
+		Expect(w.Code).To(Equal(200))
+		Expect(w.Header().Get("Warning")).To(Equal(WARNING_REVALIDATION_FAILED))
+	})
+
+	It("does not cache responses to requests with an API key or a client certificate", func() {
+		c := &Config{StaleCache: cfg, APIKeys: &APIKeysConfig{QueryParam: "api_key"}}
+		Expect(c.hasCredentials(get("http://app.example.com/?api_key=secret"))).To(BeTrue())
+		withKey := get("http://app.example.com/")
+		withKey.Header.Set(DEFAULT_API_KEY_HEADER, "secret")
+		Expect(c.hasCredentials(withKey)).To(BeTrue())
+		withCert := get("http://app.example.com/")
+		withCert.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		Expect(c.hasCredentials(withCert)).To(BeTrue())
+		Expect(c.hasCredentials(get("http://app.example.com/"))).To(BeFalse())
+
+		res := response("max-age=10")
+		res.Body = ioutil.NopCloser(strings.NewReader("private"))
+		c.cache(withCert, res)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		Expect(responseCache.Stats().Stored).To(BeZero())
+	})
+})
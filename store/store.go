@@ -13,12 +13,25 @@ const expireInSecs = 30 * time.Second
 
 type Store interface {
 	Increment(string) (int, error)
+	Take(string) Result
 	Stats() map[string]int
+	Close()
+}
+
+//Result is the outcome of taking a token for a key
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration //Until the bucket is full again
+	RetryAfter time.Duration //Until the next token is available, zero when allowed
 }
 
 type InMemoryStore struct {
 	limit   int
 	storage map[string]*entry
+	done    chan struct{}
+	closed  sync.Once
 	sync.RWMutex
 }
 
@@ -35,6 +48,7 @@ func NewStore(limit int) Store {
 	store := &InMemoryStore{
 		limit:   limit,
 		storage: make(map[string]*entry),
+		done:    make(chan struct{}),
 	}
 	store.expiryCycle()
 
@@ -42,26 +56,44 @@ func NewStore(limit int) Store {
 }
 
 func newEntry(limit int) *entry {
-	fillRatePerSec := 1000 / limit
 	return &entry{
-		bucket: ratelimit.NewBucket(time.Duration(fillRatePerSec)*time.Millisecond, int64(limit)),
+		bucket: ratelimit.NewBucket(fillInterval(limit), int64(limit)),
 	}
 }
 
+//The bucket of a limit refills one token per interval
+func fillInterval(limit int) time.Duration {
+	fillRatePerSec := 1000 / limit
+	return time.Duration(fillRatePerSec) * time.Millisecond
+}
+
 func (s *InMemoryStore) Increment(key string) (int, error) {
+	result := s.Take(key)
+	if !result.Allowed {
+		return result.Remaining, errors.New("empty bucket")
+	}
+	return result.Remaining, nil
+}
+
+//Takes a token for the key and reports the state of its bucket
+func (s *InMemoryStore) Take(key string) Result {
 	v, ok := s.get(key)
 	if !ok {
 		v = newEntry(s.limit)
 	}
-	if avail := v.bucket.Available(); avail == 0 {
-		v.updatedAt = time.Now()
-		s.set(key, v)
-		return int(avail), errors.New("empty bucket")
+	interval := fillInterval(s.limit)
+	result := Result{Limit: s.limit}
+	if v.bucket.TakeAvailable(1) == 0 {
+		result.RetryAfter = interval
+	} else {
+		result.Allowed = true
 	}
-	v.bucket.Take(1)
 	v.updatedAt = time.Now()
 	s.set(key, v)
-	return int(v.bucket.Available()), nil
+
+	result.Remaining = int(v.bucket.Available())
+	result.Reset = time.Duration(s.limit-result.Remaining) * interval
+	return result
 }
 
 func (s *InMemoryStore) get(key string) (*entry, bool) {
@@ -80,19 +112,30 @@ func (s *InMemoryStore) set(key string, value *entry) {
 func (s *InMemoryStore) expiryCycle() {
 	ticker := time.NewTicker(time.Millisecond * 500)
 	go func() {
-		for _ = range ticker.C {
-			s.Lock()
-			for k, v := range s.storage {
-				if v.Expired() {
-					fmt.Printf("removing expired key [%s]\n", k)
-					delete(s.storage, k)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Lock()
+				for k, v := range s.storage {
+					if v.Expired() {
+						fmt.Printf("removing expired key [%s]\n", k)
+						delete(s.storage, k)
+					}
 				}
+				s.Unlock()
+			case <-s.done:
+				return
 			}
-			s.Unlock()
 		}
 	}()
 }
 
+// Close stops the expiry cycle of a store that is no longer in use, it may be called more than once
+func (s *InMemoryStore) Close() {
+	s.closed.Do(func() { close(s.done) })
+}
+
 func (s *InMemoryStore) Available(key string) int {
 	v, ok := s.get(key)
 	if !ok {
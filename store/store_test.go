@@ -1,7 +1,9 @@
 package store_test
 
 import (
-	. "github.com/cloudfoundry-samples/ratelimit-service/store"
+	"time"
+
+	. "github.com/vipinvkmenon/ratelimit-service/store"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -32,4 +34,25 @@ var _ = Describe("Store", func() {
 		})
 	})
 
+	Describe("Take", func() {
+		BeforeEach(func() {
+			limit = 4
+			store = NewStore(limit)
+		})
+
+		It("reports the limit, remaining tokens and when to retry", func() {
+			result := store.Take("foo")
+			Expect(result).To(Equal(Result{Allowed: true, Limit: 4, Remaining: 3, Reset: 250 * time.Millisecond}))
+			for i := 0; i < 3; i++ {
+				Expect(store.Take("foo").Allowed).To(BeTrue())
+			}
+
+			result = store.Take("foo")
+			Expect(result.Allowed).To(BeFalse())
+			Expect(result.Remaining).To(Equal(0))
+			Expect(result.Reset).To(Equal(time.Second))
+			Expect(result.RetryAfter).To(Equal(250 * time.Millisecond))
+		})
+	})
+
 })
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+var upgrades = NewUpgradeRegistry()
+
+//StreamingConfig limits WebSocket and other upgraded connections, which are
+//counted per client while open, and optionally throttles the messages clients
+//send over WebSockets. Upgraded connections and event streams are released
+//from load shedding and fair queuing once their response started, and are
+//not delayed after the upstream responded.
+//
+//	streaming:
+//	  max_connections: 10
+//	  message_rate: 20
+//	  message_burst: 40
+//	  flush_interval: 100
+type StreamingConfig struct {
+	MaxConnections int     `json:"max_connections,omitempty" yaml:"max_connections,omitempty"` //Upgraded connections per client, no limit when unset
+	MessageRate    float64 `json:"message_rate,omitempty" yaml:"message_rate,omitempty"`       //WebSocket messages per second per connection, no limit when unset
+	MessageBurst   int     `json:"message_burst,omitempty" yaml:"message_burst,omitempty"`     //Messages sent at once, the rate rounded up by default
+	FlushInterval  int     `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"`   //Milliseconds between flushes of responses, -1 flushes every write, read at startup
+}
+
+func (c *StreamingConfig) validate() error {
+	if c.MaxConnections < 0 || c.MessageRate < 0 || c.MessageBurst < 0 || c.FlushInterval < -1 {
+		return errors.New("settings must not be negative")
+	}
+	if c.MessageRate > 0 && c.MessageBurst == 0 {
+		c.MessageBurst = int(c.MessageRate)
+		if float64(c.MessageBurst) < c.MessageRate {
+			c.MessageBurst++
+		}
+	}
+	return nil
+}
+
+//Returns the flush interval of the proxies, event streams and responses of unknown length are flushed on every write
+func flushInterval() time.Duration {
+	limiter := currentRateLimiter()
+	if limiter == nil || limiter.Config().Streaming == nil {
+		return 0
+	}
+	return time.Duration(limiter.Config().Streaming.FlushInterval) * time.Millisecond
+}
+
+//Returns whether the request asks to upgrade the connection, e.g. to a WebSocket
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns whether the response is streamed for an unbounded time: an upgraded connection or an event stream
+func isStream(res *http.Response) bool {
+	return res.StatusCode == http.StatusSwitchingProtocols ||
+		strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream")
+}
+
+//Returns the body calling done once when it is closed. The body of an upgraded
+//connection stays writable, as the proxy writes what the client sends to it.
+func onClose(body io.ReadCloser, done func()) io.ReadCloser {
+	c := &closeNotifier{ReadCloser: body, done: done}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &writableCloseNotifier{closeNotifier: c, Writer: rwc}
+	}
+	return c
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (c *closeNotifier) Close() error {
+	defer c.once.Do(c.done)
+	return c.ReadCloser.Close()
+}
+
+type writableCloseNotifier struct {
+	*closeNotifier
+	io.Writer
+}
+
+//UpgradeRegistry counts the open upgraded connections per client
+type UpgradeRegistry struct {
+	open     map[string]int
+	rejected int64
+	sync.Mutex
+}
+
+//UpgradeStats are reported in /stats/connections
+type UpgradeStats struct {
+	Open     int            `json:"open"`
+	Rejected int64          `json:"rejected"`
+	Clients  map[string]int `json:"clients"` //Open connections per client
+}
+
+func NewUpgradeRegistry() *UpgradeRegistry {
+	return &UpgradeRegistry{open: make(map[string]int)}
+}
+
+//Counts an upgraded connection of the client, returns false when it has max connections open already
+func (r *UpgradeRegistry) Acquire(client string, max int) bool {
+	r.Lock()
+	defer r.Unlock()
+	if max > 0 && r.open[client] >= max {
+		r.rejected++
+		return false
+	}
+	r.open[client]++
+	return true
+}
+
+func (r *UpgradeRegistry) Release(client string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.open[client]--; r.open[client] <= 0 {
+		delete(r.open, client)
+	}
+}
+
+func (r *UpgradeRegistry) Stats() UpgradeStats {
+	r.Lock()
+	defer r.Unlock()
+	stats := UpgradeStats{Rejected: r.rejected, Clients: make(map[string]int)}
+	clients := make([]string, 0, len(r.open))
+	for client := range r.open {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		stats.Clients[client] = r.open[client]
+		stats.Open += r.open[client]
+	}
+	return stats
+}
+
+func upgradeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := json.Marshal(upgrades.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "%s", stats)
+}
+
+//Throttles the WebSocket messages a client sends over an upgraded connection,
+//by parsing the frames the proxy writes to the upstream
+type messageLimiter struct {
+	io.ReadWriteCloser
+	bucket *ratelimit.Bucket
+
+	header []byte //Of the frame being parsed
+	needed int    //Bytes of the header, known once its first 2 bytes were read
+	remain uint64 //Bytes of the payload of the current frame not written yet
+}
+
+func newMessageLimiter(conn io.ReadWriteCloser, c *StreamingConfig) *messageLimiter {
+	return &messageLimiter{ReadWriteCloser: conn, bucket: ratelimit.NewBucketWithRate(c.MessageRate, int64(c.MessageBurst))}
+}
+
+func (m *messageLimiter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		if m.remain > 0 {
+			n := uint64(len(rest))
+			if n > m.remain {
+				n = m.remain
+			}
+			m.remain -= n
+			rest = rest[n:]
+			continue
+		}
+		m.header = append(m.header, rest[0])
+		rest = rest[1:]
+		if len(m.header) == 2 {
+			m.needed = frameHeaderLength(m.header)
+		}
+		if len(m.header) < 2 || len(m.header) < m.needed {
+			continue
+		}
+		fin, opcode := m.header[0]&0x80 != 0, m.header[0]&0x0f
+		if fin && opcode < 8 { //The last frame of a data message, control frames are not counted
+			m.bucket.Wait(1)
+		}
+		m.remain = payloadLength(m.header)
+		m.header = m.header[:0]
+	}
+	return m.ReadWriteCloser.Write(p)
+}
+
+//Returns the length of the header of a WebSocket frame from its first 2 bytes
+func frameHeaderLength(header []byte) int {
+	n := 2
+	switch header[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if header[1]&0x80 != 0 { //Masking key
+		n += 4
+	}
+	return n
+}
+
+func payloadLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
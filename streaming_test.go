@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//A masked WebSocket frame, with a zero masking key
+func frame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	f := []byte{first}
+	if len(payload) < 126 {
+		f = append(f, 0x80|byte(len(payload)))
+	} else {
+		f = append(f, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	return append(append(f, 0, 0, 0, 0), payload...)
+}
+
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error { return nil }
+
+var _ = Describe("Streaming", func() {
+	var cfg *StreamingConfig
+
+	BeforeEach(func() {
+		cfg = &StreamingConfig{MaxConnections: 1, MessageRate: 1, MessageBurst: 3}
+		Expect(cfg.validate()).To(Succeed())
+		upgrades = NewUpgradeRegistry()
+	})
+
+	It("counts the messages clients send by parsing their frames", func() {
+		conn := &bufferConn{}
+		limiter := newMessageLimiter(conn, cfg)
+		large := frame(true, 1, []byte(strings.Repeat("x", 300)))
+		limiter.Write(large[:3])
+		limiter.Write(large[3:])
+		limiter.Write(frame(true, 9, []byte("ping")))
+		limiter.Write(append(frame(false, 1, []byte("first part")), frame(true, 0, []byte("last part"))...))
+		Expect(limiter.bucket.Available()).To(Equal(int64(1)))
+		Expect(conn.Len()).To(Equal(len(large) + 4 + 6 + 10 + 6 + 9 + 6))
+	})
+
+	It("detects upgrades and streams", func() {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		Expect(isUpgrade(req)).To(BeFalse())
+		req.Header.Set("Connection", "keep-alive, Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		Expect(isUpgrade(req)).To(BeTrue())
+
+		Expect(isStream(&http.Response{StatusCode: 101})).To(BeTrue())
+		Expect(isStream(&http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}})).To(BeTrue())
+		Expect(isStream(&http.Response{StatusCode: 200, Header: http.Header{}})).To(BeFalse())
+	})
+
+	It("proxies WebSocket upgrades and limits the connections per client", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			rw.Flush()
+			io.Copy(conn, rw) //Echoes what the client sends
+		}))
+		defer backend.Close()
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100, Streaming: cfg}, nil)
+		proxy := httptest.NewServer(newProxy())
+		defer proxy.Close()
+
+		dial := func() (net.Conn, *bufio.Reader, *http.Response) {
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: ratelimiter.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+				CF_FORWARDED_URL + ": " + backend.URL + "/socket\r\n\r\n"))
+			reader := bufio.NewReader(conn)
+			res, err := http.ReadResponse(reader, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return conn, reader, res
+		}
+
+		conn, reader, res := dial()
+		Expect(res.StatusCode).To(Equal(101))
+		message := frame(true, 1, []byte("hello"))
+		conn.Write(message)
+		echo := make([]byte, len(message))
+		_, err := io.ReadFull(reader, echo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(echo).To(Equal(message))
+		Expect(upgrades.Stats().Open).To(Equal(1))
+
+		second, _, res := dial()
+		Expect(res.StatusCode).To(Equal(429))
+		second.Close()
+
+		conn.Close()
+		Eventually(func() int { return upgrades.Stats().Open }).Should(Equal(0))
+		Expect(upgrades.Stats().Rejected).To(Equal(int64(1)))
+	})
+
+	It("fails upgrades whose connection is not writable", func() {
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 100}, nil)
+		tr := &http.Transport{}
+		tr.RegisterProtocol("http", readOnlyUpgrade{})
+		pool := newTransportPool()
+		pool.transports[TransportConfig{}] = tr
+
+		req := httptest.NewRequest("GET", "http://app.example.com/socket", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		res, err := (&RateLimitedRoundTripper{transports: pool}).RoundTrip(req)
+		Expect(err).To(HaveOccurred())
+		Expect(res).To(BeNil())
+		Expect(upgrades.Stats().Open).To(BeZero())
+	})
+})
+
+//Answers every request with a 101 whose body cannot be written to
+type readOnlyUpgrade struct{}
+
+func (readOnlyUpgrade) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
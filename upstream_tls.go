@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//UpstreamTLS configures how the certificates of upstreams are verified, and
+//the client certificate presented to them. Without it certificates are only
+//verified when SKIP_SSL_VALIDATION is false.
+//
+//	upstream_tls:
+//	  ca_file: /home/vcap/app/ca.pem
+//	  cert_env: UPSTREAM_CLIENT_CERT
+//	  key_env: UPSTREAM_CLIENT_KEY
+//	  min_version: "1.2"
+//	  hosts:
+//	    legacy.example.com:
+//	      skip_verify: true
+type UpstreamTLS struct {
+	TLSSettings `yaml:",inline"`
+	Hosts       map[string]*TLSSettings `json:"hosts,omitempty" yaml:"hosts,omitempty"` //Overrides per destination host
+
+	config *tls.Config
+	hosts  map[string]*tls.Config
+}
+
+//TLSSettings are read from files, or from env vars holding the PEM data
+type TLSSettings struct {
+	CAFile     string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+	CAEnv      string `json:"ca_env,omitempty" yaml:"ca_env,omitempty"`
+	CertFile   string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	CertEnv    string `json:"cert_env,omitempty" yaml:"cert_env,omitempty"`
+	KeyFile    string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	KeyEnv     string `json:"key_env,omitempty" yaml:"key_env,omitempty"`
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version,omitempty"`
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	SkipVerify *bool  `json:"skip_verify,omitempty" yaml:"skip_verify,omitempty"`
+}
+
+//Validates the settings and loads the CA bundles and client certificates
+func (u *UpstreamTLS) validate() error {
+	config, err := u.TLSSettings.build()
+	if err != nil {
+		return err
+	}
+	u.config = config
+	u.hosts = make(map[string]*tls.Config)
+	for host, settings := range u.Hosts {
+		config, err := u.TLSSettings.merge(settings).build()
+		if err != nil {
+			return fmt.Errorf("host %s: %s", host, err)
+		}
+		u.hosts[strings.ToLower(host)] = config
+	}
+	return nil
+}
+
+//Returns the settings with the fields set in override replaced
+func (s TLSSettings) merge(override *TLSSettings) TLSSettings {
+	merged := s
+	if override.CAFile != "" || override.CAEnv != "" {
+		merged.CAFile, merged.CAEnv = override.CAFile, override.CAEnv
+	}
+	if override.CertFile != "" || override.CertEnv != "" {
+		merged.CertFile, merged.CertEnv = override.CertFile, override.CertEnv
+		merged.KeyFile, merged.KeyEnv = override.KeyFile, override.KeyEnv
+	}
+	if override.MinVersion != "" {
+		merged.MinVersion = override.MinVersion
+	}
+	if override.ServerName != "" {
+		merged.ServerName = override.ServerName
+	}
+	if override.SkipVerify != nil {
+		merged.SkipVerify = override.SkipVerify
+	}
+	return merged
+}
+
+func (s TLSSettings) build() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: s.SkipVerify != nil && *s.SkipVerify,
+		ServerName:         s.ServerName,
+	}
+	if s.MinVersion != "" {
+		version, ok := tlsVersions[s.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("min_version must be 1.0, 1.1, 1.2 or 1.3, got %q", s.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	ca, err := readPEM(s.CAFile, s.CAEnv)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in the CA bundle")
+		}
+	}
+
+	cert, err := readPEM(s.CertFile, s.CertEnv)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPEM(s.KeyFile, s.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if (cert == nil) != (key == nil) {
+		return nil, errors.New("a client certificate requires both a certificate and a key")
+	}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+//Reads PEM data from the file, or from the env var, nil when neither is set
+func readPEM(file string, env string) ([]byte, error) {
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	if env == "" {
+		return nil, nil
+	}
+	data := os.Getenv(env)
+	if data == "" {
+		return nil, fmt.Errorf("env var %s is empty", env)
+	}
+	return []byte(data), nil
+}
+
+//Returns the files the settings are read from
+func (u *UpstreamTLS) files() []string {
+	settings := []*TLSSettings{&u.TLSSettings}
+	for _, s := range u.Hosts {
+		settings = append(settings, s)
+	}
+	var files []string
+	for _, s := range settings {
+		for _, file := range []string{s.CAFile, s.CertFile, s.KeyFile} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+//Returns the TLS config for connections to the host
+func (c *Config) upstreamTLSConfig(host string) *tls.Config {
+	var config *tls.Config
+	switch {
+	case c.UpstreamTLS == nil:
+		config = &tls.Config{InsecureSkipVerify: skipSslValidation()}
+	case c.UpstreamTLS.hosts[strings.ToLower(host)] != nil:
+		config = c.UpstreamTLS.hosts[strings.ToLower(host)].Clone()
+	default:
+		config = c.UpstreamTLS.config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+//Dials TLS connections to upstreams with the TLS config of the current config. The transport
+//ignores its TLSHandshakeTimeout for custom dialers, so the handshake is bounded here.
+func dialTLS(dialer *net.Dialer, http2 bool, handshakeTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := currentRateLimiter().Config().upstreamTLSConfig(host)
+		if http2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsConn := tls.Client(conn, config)
+		handshakeCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//Returns a self-signed certificate and its key, PEM encoded
+func selfSigned(name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+var _ = Describe("Upstream TLS", func() {
+	var (
+		backend *httptest.Server
+		tempDir string
+		caFile  string
+		clients chan string
+	)
+
+	BeforeEach(func() {
+		clients = make(chan string, 1)
+		backend = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.PeerCertificates) > 0 {
+				clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+			}
+		}))
+		backend.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		backend.StartTLS()
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "upstream-tls")
+		Expect(err).ToNot(HaveOccurred())
+		caFile = filepath.Join(tempDir, "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+		Expect(ioutil.WriteFile(caFile, ca, 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		backend.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	get := func(upstreamTLS *UpstreamTLS) error {
+		cfg := &Config{Version: CONFIG_VERSION, Limit: 10, UpstreamTLS: upstreamTLS}
+		Expect(cfg.Validate()).To(Succeed())
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		client := &http.Client{Transport: &http.Transport{DialTLSContext: dialTLS(&net.Dialer{}, false, time.Second)}}
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	It("verifies upstream certificates with the CA bundle", func() {
+		Expect(get(&UpstreamTLS{})).To(MatchError(ContainSubstring("certificate")))
+		Expect(get(&UpstreamTLS{TLSSettings: TLSSettings{CAFile: caFile}})).To(Succeed())
+	})
+
+	It("overrides verification per host", func() {
+		skip := true
+		host := strings.Split(strings.TrimPrefix(backend.URL, "https://"), ":")[0]
+		Expect(get(&UpstreamTLS{Hosts: map[string]*TLSSettings{host: {SkipVerify: &skip}}})).To(Succeed())
+		Expect(get(&UpstreamTLS{Hosts: map[string]*TLSSettings{"other.example.com": {SkipVerify: &skip}}})).ToNot(Succeed())
+	})
+
+	It("presents the client certificate from env", func() {
+		cert, key := selfSigned("ratelimiter")
+		os.Setenv("TEST_UPSTREAM_CERT", string(cert))
+		os.Setenv("TEST_UPSTREAM_KEY", string(key))
+		defer os.Unsetenv("TEST_UPSTREAM_CERT")
+		defer os.Unsetenv("TEST_UPSTREAM_KEY")
+
+		Expect(get(&UpstreamTLS{TLSSettings: TLSSettings{CAFile: caFile, CertEnv: "TEST_UPSTREAM_CERT", KeyEnv: "TEST_UPSTREAM_KEY"}})).To(Succeed())
+		Expect(<-clients).To(Equal("ratelimiter"))
+	})
+
+	It("gives up on upstreams that stall the handshake", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(5 * time.Second) //Never answers the client hello
+			}
+		}()
+
+		rateLimiter = NewRateLimiterFromConfig(&Config{Version: CONFIG_VERSION, Limit: 10}, nil)
+		start := time.Now()
+		_, err = dialTLS(&net.Dialer{}, false, 200*time.Millisecond)(context.Background(), "tcp", l.Addr().String())
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("validates the settings", func() {
+		Expect((&UpstreamTLS{TLSSettings: TLSSettings{MinVersion: "1.4"}}).validate()).To(MatchError(ContainSubstring("min_version")))
+		Expect((&UpstreamTLS{TLSSettings: TLSSettings{CertFile: caFile}}).validate()).To(MatchError(ContainSubstring("both a certificate and a key")))
+		Expect((&UpstreamTLS{Hosts: map[string]*TLSSettings{"a": {CAFile: filepath.Join(tempDir, "missing.pem")}}}).validate()).To(HaveOccurred())
+	})
+
+	It("keeps SKIP_SSL_VALIDATION when not configured", func() {
+		os.Setenv("SKIP_SSL_VALIDATION", "false")
+		defer os.Unsetenv("SKIP_SSL_VALIDATION")
+		Expect((&Config{}).upstreamTLSConfig("example.com").InsecureSkipVerify).To(BeFalse())
+		Expect((&Config{}).upstreamTLSConfig("example.com").ServerName).To(Equal("example.com"))
+	})
+})
+
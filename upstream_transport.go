@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Go's http.DefaultTransport settings, used for unset fields
+const (
+	DEFAULT_DIAL_TIMEOUT          = 30 //Seconds
+	DEFAULT_KEEP_ALIVE            = 30 //Seconds
+	DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 //Seconds
+	DEFAULT_IDLE_CONN_TIMEOUT     = 90 //Seconds
+	DEFAULT_MAX_IDLE_CONNS        = 100
+)
+
+//Shared by the proxies, so connection limits apply per host across them
+var upstreamTransports = newTransportPool()
+
+//TransportConfig tunes the connections to upstreams. Timeouts are in seconds,
+//zero fields use the defaults of Go's http.DefaultTransport. Rules can override
+//single fields, e.g. to give slow endpoints a longer timeout.
+//
+//	upstream:
+//	  dial_timeout: 5
+//	  response_header_timeout: 10
+//	  max_idle_conns_per_host: 20
+//	  http2: true
+//	rules:
+//	  - name: reports
+//	    limit: 2
+//	    upstream:
+//	      response_header_timeout: 120
+type TransportConfig struct {
+	DialTimeout           int  `json:"dial_timeout,omitempty" yaml:"dial_timeout,omitempty"`
+	KeepAlive             int  `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty"`
+	TLSHandshakeTimeout   int  `json:"tls_handshake_timeout,omitempty" yaml:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout int  `json:"response_header_timeout,omitempty" yaml:"response_header_timeout,omitempty"` //No timeout by default
+	IdleConnTimeout       int  `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout,omitempty"`
+	MaxIdleConns          int  `json:"max_idle_conns,omitempty" yaml:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int  `json:"max_idle_conns_per_host,omitempty" yaml:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost       int  `json:"max_conns_per_host,omitempty" yaml:"max_conns_per_host,omitempty"` //No limit by default
+	HTTP2                 bool `json:"http2,omitempty" yaml:"http2,omitempty"`
+	H2C                   bool `json:"h2c,omitempty" yaml:"h2c,omitempty"`         //Cleartext HTTP/2 to http:// upstreams, HTTP/2 only, always used for gRPC
+	Timeout               int  `json:"timeout,omitempty" yaml:"timeout,omitempty"` //Of the whole request, no timeout by default
+}
+
+func (t *TransportConfig) validate() error {
+	for _, v := range []int{t.DialTimeout, t.KeepAlive, t.TLSHandshakeTimeout, t.ResponseHeaderTimeout,
+		t.IdleConnTimeout, t.MaxIdleConns, t.MaxIdleConnsPerHost, t.MaxConnsPerHost, t.Timeout} {
+		if v < 0 {
+			return errors.New("timeouts and connection limits must not be negative")
+		}
+	}
+	return nil
+}
+
+//Returns the settings with the fields set in override replaced
+func (t TransportConfig) merge(override *TransportConfig) TransportConfig {
+	if override == nil {
+		return t
+	}
+	merged := t
+	set := func(field *int, value int) {
+		if value != 0 {
+			*field = value
+		}
+	}
+	set(&merged.DialTimeout, override.DialTimeout)
+	set(&merged.KeepAlive, override.KeepAlive)
+	set(&merged.TLSHandshakeTimeout, override.TLSHandshakeTimeout)
+	set(&merged.ResponseHeaderTimeout, override.ResponseHeaderTimeout)
+	set(&merged.IdleConnTimeout, override.IdleConnTimeout)
+	set(&merged.MaxIdleConns, override.MaxIdleConns)
+	set(&merged.MaxIdleConnsPerHost, override.MaxIdleConnsPerHost)
+	set(&merged.MaxConnsPerHost, override.MaxConnsPerHost)
+	set(&merged.Timeout, override.Timeout)
+	merged.HTTP2 = merged.HTTP2 || override.HTTP2
+	merged.H2C = merged.H2C || override.H2C
+	return merged
+}
+
+func secondsOr(value int, defaultValue int) time.Duration {
+	if value == 0 {
+		value = defaultValue
+	}
+	return time.Duration(value) * time.Second
+}
+
+func (t TransportConfig) newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   secondsOr(t.DialTimeout, DEFAULT_DIAL_TIMEOUT),
+		KeepAlive: secondsOr(t.KeepAlive, DEFAULT_KEEP_ALIVE),
+		Control:   dialControl,
+	}
+	maxIdleConns := t.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = DEFAULT_MAX_IDLE_CONNS
+	}
+	tr := &http.Transport{
+		DialContext:           dialer.DialContext,
+		DialTLSContext:        dialTLS(dialer, t.HTTP2 || t.H2C, secondsOr(t.TLSHandshakeTimeout, DEFAULT_TLS_HANDSHAKE_TIMEOUT)), //TLS settings follow the current config, see upstream_tls.go
+		ResponseHeaderTimeout: secondsOr(t.ResponseHeaderTimeout, 0),
+		IdleConnTimeout:       secondsOr(t.IdleConnTimeout, DEFAULT_IDLE_CONN_TIMEOUT),
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		ForceAttemptHTTP2:     t.HTTP2,
+	}
+	if t.H2C {
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return tr
+}
+
+//Returns the transport settings for requests matching the rule, which is nil when no rule matched
+func (c *Config) transportFor(rule *Rule) TransportConfig {
+	var t TransportConfig
+	if c.Upstream != nil {
+		t = *c.Upstream
+	}
+	if rule != nil {
+		t = t.merge(rule.Upstream)
+	}
+	return t
+}
+
+//Returns the transport settings requests may be sent with under the config, as
+//keyed in the transport pool
+func (c *Config) transportKeys() map[TransportConfig]bool {
+	keys := make(map[TransportConfig]bool)
+	add := func(rule *Rule) {
+		t := c.transportFor(rule)
+		t.Timeout = 0
+		keys[t] = true
+		t.H2C = true //gRPC calls
+		keys[t] = true
+	}
+	addRules := func(rules []Rule) {
+		for i := range rules {
+			add(&rules[i])
+		}
+	}
+	add(nil)
+	addRules(c.Rules)
+	for _, instance := range c.Instances {
+		addRules(instance.Rules)
+		for _, binding := range instance.Bindings {
+			addRules(binding.Rules)
+		}
+	}
+	for _, destination := range c.Destinations {
+		addRules(destination.Rules)
+	}
+	return keys
+}
+
+//transportPool shares one transport, and so one connection pool, between all
+//requests with the same transport settings
+type transportPool struct {
+	transports map[TransportConfig]*http.Transport
+	sync.Mutex
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{transports: make(map[TransportConfig]*http.Transport)}
+}
+
+func (p *transportPool) get(t TransportConfig) *http.Transport {
+	t.Timeout = 0 //Applied per request, not by the transport
+	p.Lock()
+	defer p.Unlock()
+	tr, ok := p.transports[t]
+	if !ok {
+		tr = t.newTransport()
+		p.transports[t] = tr
+	}
+	return tr
+}
+
+//Drops the transports for settings not in keep and closes their idle connections.
+//Requests in flight on them complete, their connections are closed once idle
+//for the idle timeout.
+func (p *transportPool) retain(keep map[TransportConfig]bool) {
+	p.Lock()
+	defer p.Unlock()
+	for t, tr := range p.transports {
+		if !keep[t] {
+			tr.CloseIdleConnections()
+			delete(p.transports, t)
+		}
+	}
+}
+
+//Sends the request with the transport for the settings, within the request
+//timeout. Upgraded connections outlive the request, so the timeout does not
+//apply to them.
+func (p *transportPool) roundTrip(req *http.Request, t TransportConfig) (*http.Response, error) {
+	if t.Timeout == 0 || isUpgrade(req) {
+		return p.get(t).RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(t.Timeout)*time.Second)
+	res, err := p.get(t).RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = onClose(res.Body, cancel) //Releases the timeout once the body is closed
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream transport", func() {
+	var cfg *Config
+
+	BeforeEach(func() {
+		cfg = &Config{
+			Version:  CONFIG_VERSION,
+			Limit:    100,
+			Upstream: &TransportConfig{DialTimeout: 5, ResponseHeaderTimeout: 10, MaxIdleConnsPerHost: 20},
+			Rules: []Rule{
+				{Name: "slow", Limit: 100, Match: Match{PathPrefix: "/slow"}, Upstream: &TransportConfig{Timeout: 1, ResponseHeaderTimeout: 120}},
+			},
+		}
+		Expect(cfg.Validate()).To(Succeed())
+	})
+
+	It("applies rule overrides on top of the upstream settings", func() {
+		Expect(cfg.transportFor(nil)).To(Equal(*cfg.Upstream))
+		Expect(cfg.transportFor(&cfg.Rules[0])).To(Equal(TransportConfig{
+			DialTimeout: 5, ResponseHeaderTimeout: 120, MaxIdleConnsPerHost: 20, Timeout: 1,
+		}))
+	})
+
+	It("shares transports between requests with the same settings", func() {
+		pool := newTransportPool()
+		tr := pool.get(cfg.transportFor(nil))
+		Expect(tr.ResponseHeaderTimeout).To(Equal(10 * time.Second))
+		Expect(tr.MaxIdleConnsPerHost).To(Equal(20))
+		Expect(tr.IdleConnTimeout).To(Equal(DEFAULT_IDLE_CONN_TIMEOUT * time.Second))
+		Expect(pool.get(cfg.transportFor(nil)) == tr).To(BeTrue())
+		Expect(pool.get(cfg.transportFor(&cfg.Rules[0])) == tr).To(BeFalse())
+	})
+
+	It("closes the transports the config no longer uses", func() {
+		pool := newTransportPool()
+		kept := pool.get(cfg.transportFor(nil))
+		dropped := pool.get(TransportConfig{DialTimeout: 1})
+		pool.retain(cfg.transportKeys())
+		Expect(pool.get(cfg.transportFor(nil)) == kept).To(BeTrue())
+		Expect(pool.get(TransportConfig{DialTimeout: 1}) == dropped).To(BeFalse())
+		Expect(cfg.transportKeys()).To(HaveKey(TransportConfig{DialTimeout: 5, ResponseHeaderTimeout: 120, MaxIdleConnsPerHost: 20}))
+	})
+
+	It("does not apply the timeout to upgraded connections", func() {
+		pool := newTransportPool()
+		var deadlines []bool
+		pool.transports[TransportConfig{}] = &http.Transport{Proxy: func(r *http.Request) (*url.URL, error) {
+			_, ok := r.Context().Deadline()
+			deadlines = append(deadlines, ok)
+			return nil, errors.New("not sent")
+		}}
+		req := httptest.NewRequest("GET", "http://app.example.com/socket", nil)
+		pool.roundTrip(req, TransportConfig{Timeout: 1})
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		pool.roundTrip(req, TransportConfig{Timeout: 1})
+		Expect(deadlines).To(Equal([]bool{true, false}))
+	})
+
+	It("answers requests exceeding the timeout of their rule with 504", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(1500 * time.Millisecond)
+			}
+		}))
+		defer backend.Close()
+		rateLimiter = NewRateLimiterFromConfig(cfg, nil)
+		proxy := newProxy()
+
+		serve := func(path string) int {
+			req := httptest.NewRequest("GET", "http://ratelimiter.example.com/", nil)
+			req.Header.Set(CF_FORWARDED_URL, backend.URL+path)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			return w.Code
+		}
+		Expect(serve("/fast")).To(Equal(http.StatusOK))
+		Expect(serve("/slow")).To(Equal(http.StatusGatewayTimeout))
+	})
+
+	It("rejects negative settings", func() {
+		cfg.Rules[0].Upstream.Timeout = -1
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("must not be negative")))
+	})
+})